@@ -2,9 +2,12 @@ package sshtermbox
 
 import (
 	"bytes"
+	"fmt"
 	"io"
-	"log"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"context"
 	"errors"
@@ -36,21 +39,32 @@ type Termbox struct {
 	inbuf          []byte
 	outbuf         bytes.Buffer
 	quit           chan int
+	quitOnce       sync.Once
 	input_comm     chan input_event
 	interrupt_comm chan struct{}
 	intbuf         []byte
 	resize_comm    chan struct{}
+	signal_comm    chan string
 
 	newW     int
 	newH     int
 	sizeLock sync.Mutex
 
+	flush_hook  func(time.Duration, int)
+	flush_bytes int
+
+	out_lock   sync.Mutex
+	last_input int64 // unix nanoseconds, accessed atomically
+	resync     int32 // set atomically when the screen needs a full redraw
+
 	// grayscale indexes
 	grayscale []Attribute
 }
 
 func (t *Termbox) writeString(str string) {
+	t.out_lock.Lock()
 	io.WriteString(t.out, str)
+	t.out_lock.Unlock()
 }
 
 // public API
@@ -83,7 +97,9 @@ func Init(in io.Reader, out io.Writer, term string, w, h int) (*Termbox, error)
 		input_comm:     make(chan input_event),
 		interrupt_comm: make(chan struct{}),
 		resize_comm:    make(chan struct{}, 1),
+		signal_comm:    make(chan string, 16),
 		intbuf:         make([]byte, 0, 16),
+		last_input:     time.Now().UnixNano(),
 		grayscale: []Attribute{
 			0, 17, 233, 234, 235, 236, 237, 238, 239, 240, 241, 242, 243, 244,
 			245, 246, 247, 248, 249, 250, 251, 252, 253, 254, 255, 256, 232,
@@ -112,14 +128,22 @@ func Init(in io.Reader, out io.Writer, term string, w, h int) (*Termbox, error)
 	termbox.front_buffer.clear(termbox.foreground, termbox.background)
 	buf := make([]byte, 0, 128)
 	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				termbox.input_error(fmt.Errorf("termbox: panic reading input: %v", r))
+			}
+		}()
 		for {
 			n, err := termbox.in.Read(buf)
 			if err != nil {
 				if err != io.EOF {
-					log.Fatal(err)
+					termbox.input_error(err)
 				}
 				break
 			}
+			if n > 0 {
+				atomic.StoreInt64(&termbox.last_input, time.Now().UnixNano())
+			}
 			select {
 			case termbox.input_comm <- input_event{buf[:n], err}:
 				ie := <-termbox.input_comm
@@ -139,26 +163,67 @@ func (t *Termbox) Interrupt() {
 	t.interrupt_comm <- struct{}{}
 }
 
+// Signal delivers a signal, such as "INT" or "BREAK", to PollEvent as an
+// EventSignal. Signals are dropped if too many are pending.
+func (t *Termbox) Signal(name string) {
+	select {
+	case t.signal_comm <- name:
+	default:
+	}
+}
+
 // Finalizes termbox library, should be called after successful initialization
-// when termbox's functionality isn't required anymore.
+// when termbox's functionality isn't required anymore. Calling Close more than
+// once has no further effect.
 func (t *Termbox) Close() {
-	t.quit <- 1
-	t.writeString(t.funcs[t_show_cursor])
-	t.writeString(t.funcs[t_sgr0])
-	t.writeString(t.funcs[t_clear_screen])
-	t.writeString(t.funcs[t_exit_ca])
-	t.writeString(t.funcs[t_exit_keypad])
-	t.writeString(t.funcs[t_exit_mouse])
+	t.quitOnce.Do(func() {
+		close(t.quit)
+		t.writeString(t.funcs[t_show_cursor])
+		t.writeString(t.funcs[t_sgr0])
+		t.writeString(t.funcs[t_clear_screen])
+		t.writeString(t.funcs[t_exit_ca])
+		t.writeString(t.funcs[t_exit_keypad])
+		t.writeString(t.funcs[t_exit_mouse])
+	})
+}
+
+// Sets a function to be called after every Flush with the time it took and
+// the number of bytes it wrote to the terminal. Pass nil to remove it.
+func (t *Termbox) SetFlushHook(f func(d time.Duration, n int)) {
+	t.flush_hook = f
+}
+
+// Reports whether Close has been called.
+func (t *Termbox) Closed() bool {
+	select {
+	case <-t.quit:
+		return true
+	default:
+		return false
+	}
 }
 
 // Synchronizes the internal back buffer with the terminal.
 func (t *Termbox) Flush() error {
+	if t.flush_hook != nil {
+		start := time.Now()
+		t.flush_bytes = 0
+		defer func() {
+			t.flush_hook(time.Since(start), t.flush_bytes)
+		}()
+	}
+
 	// invalidate cursor position
 	t.lastx = coord_invalid
 	t.lasty = coord_invalid
 
 	t.update_size_maybe()
 
+	if atomic.CompareAndSwapInt32(&t.resync, 1, 0) {
+		t.front_buffer.invalidate()
+		t.lastfg, t.lastbg = attr_invalid, attr_invalid
+	}
+
 	for y := 0; y < t.front_buffer.height; y++ {
 		line_offset := y * t.front_buffer.width
 		for x := 0; x < t.front_buffer.width; {
@@ -203,6 +268,52 @@ func (t *Termbox) Flush() error {
 	return t.flush()
 }
 
+// Returns the time input was last received from the terminal, or the time of
+// Init if there has been none. It is safe to call from any goroutine.
+func (t *Termbox) LastInput() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.last_input))
+}
+
+// Writes msg straight to the terminal in reverse video on its bottom line,
+// on top of whatever is displayed and without touching the buffers. It is
+// safe to call from any goroutine, e.g. to warn the user from outside the
+// application. The next Flush redraws the whole screen, removing it.
+func (t *Termbox) Overlay(msg string) {
+	t.sizeLock.Lock()
+	w, h := t.newW, t.newH
+	t.sizeLock.Unlock()
+	if w <= 0 || h <= 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\0337")
+	buf.WriteString("\033[")
+	buf.WriteString(strconv.Itoa(h))
+	buf.WriteString(";1H")
+	buf.WriteString(t.funcs[t_sgr0])
+	buf.WriteString(t.funcs[t_reverse])
+	x := 0
+	for _, r := range msg {
+		rw := runewidth.RuneWidth(r)
+		if r < ' ' || x+rw > w {
+			continue
+		}
+		buf.WriteRune(r)
+		x += rw
+	}
+	for ; x < w; x++ {
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(t.funcs[t_sgr0])
+	buf.WriteString("\0338")
+
+	atomic.StoreInt32(&t.resync, 1)
+	t.out_lock.Lock()
+	t.out.Write(buf.Bytes())
+	t.out_lock.Unlock()
+}
+
 // Sets the position of the cursor. See also HideCursor().
 func (t *Termbox) SetCursor(x, y int) {
 	if t.is_cursor_hidden(t.cursor_x, t.cursor_y) && !t.is_cursor_hidden(x, y) {
@@ -302,6 +413,10 @@ func (t *Termbox) PollRawEvent(data []byte) Event {
 			event.Width, event.Height = t.newW, t.newH
 			t.sizeLock.Unlock()
 			return event
+		case sig := <-t.signal_comm:
+			event.Type = EventSignal
+			event.Signal = sig
+			return event
 		}
 	}
 }
@@ -348,6 +463,10 @@ func (t *Termbox) PollEvent() Event {
 			event.Width, event.Height = t.newW, t.newH
 			t.sizeLock.Unlock()
 			return event
+		case sig := <-t.signal_comm:
+			event.Type = EventSignal
+			event.Signal = sig
+			return event
 		}
 	}
 	panic("unreachable")
@@ -394,6 +513,10 @@ func (t *Termbox) PollEventWithContext(ctx context.Context) Event {
 			event.Width, event.Height = t.newW, t.newH
 			t.sizeLock.Unlock()
 			return event
+		case sig := <-t.signal_comm:
+			event.Type = EventSignal
+			event.Signal = sig
+			return event
 		case <-ctx.Done():
 			event.Type = EventCancel
 			return event
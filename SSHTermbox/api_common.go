@@ -15,6 +15,7 @@ type (
 // This type represents a termbox event. The 'Mod', 'Key' and 'Ch' fields are
 // valid if 'Type' is EventKey. The 'Width' and 'Height' fields are valid if
 // 'Type' is EventResize. The 'Err' field is valid if 'Type' is EventError.
+// The 'Signal' field is valid if 'Type' is EventSignal.
 type Event struct {
 	Type   EventType // one of Event* constants
 	Mod    Modifier  // one of Mod* constants or 0
@@ -26,6 +27,7 @@ type Event struct {
 	MouseX int       // x coord of mouse
 	MouseY int       // y coord of mouse
 	N      int       // number of bytes written when getting a raw event
+	Signal string    // signal name without "SIG", or "BREAK"
 }
 
 // A cell, single conceptual entity on the screen. The screen is basically a 2d
@@ -180,4 +182,5 @@ const (
 	EventRaw
 	EventNone
 	EventCancel
+	EventSignal
 )
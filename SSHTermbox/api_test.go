@@ -70,3 +70,25 @@ func TestDeadlineEventPolling(t *testing.T) {
 	ctx, _ := context.WithTimeout(context.Background(), 0*time.Second)
 	term.PollEventWithContext(ctx)
 }
+
+func TestSignalEventPoll(t *testing.T) {
+	inTerm, _ := io.Pipe()
+	out, outTerm := io.Pipe()
+
+	go consume(t, out)
+
+	term, err := Init(inTerm, outTerm, "xterm", 0, 0)
+	if err != nil {
+		t.Errorf("error initializing a sshterm: %v", err)
+		return
+	}
+
+	term.Signal("INT")
+	term.Signal("BREAK")
+	for _, want := range []string{"INT", "BREAK"} {
+		ev := term.PollEvent()
+		if ev.Type != EventSignal || ev.Signal != want {
+			t.Errorf("expected signal event %q, got %+v", want, ev)
+		}
+	}
+}
@@ -37,6 +37,15 @@ type input_event struct {
 	err  error
 }
 
+// input_error hands a read error to the next PollEvent call, unless the
+// termbox is closed first.
+func (t *Termbox) input_error(err error) {
+	select {
+	case t.input_comm <- input_event{nil, err}:
+	case <-t.quit:
+	}
+}
+
 func (t *Termbox) write_cursor(x, y int) {
 	t.outbuf.WriteString("\033[")
 	t.outbuf.Write(strconv.AppendUint(t.intbuf, uint64(y+1), 10))
@@ -174,7 +183,10 @@ func (t *Termbox) send_char(x, y int, ch rune) {
 }
 
 func (t *Termbox) flush() error {
+	t.flush_bytes += t.outbuf.Len()
+	t.out_lock.Lock()
 	_, err := io.Copy(t.out, &t.outbuf)
+	t.out_lock.Unlock()
 	t.outbuf.Reset()
 	if err != nil {
 		return err
@@ -209,9 +221,13 @@ func (t *Termbox) Resize(newW, newH int) {
 	}
 	t.sizeLock.Unlock()
 	if changed {
-		t.resize_comm <- struct{}{}
+		// a pending notification is enough, the poller reads the latest
+		// size when it handles it
+		select {
+		case t.resize_comm <- struct{}{}:
+		default:
+		}
 	}
-
 }
 
 func (t *Termbox) update_size_maybe() error {
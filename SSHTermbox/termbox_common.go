@@ -52,6 +52,14 @@ func (this *cellbuf) clear(fg, bg Attribute) {
 	}
 }
 
+// invalidate makes every cell differ from any real one, so the next Flush
+// redraws them all.
+func (this *cellbuf) invalidate() {
+	for i := range this.cells {
+		this.cells[i].Fg = attr_invalid
+	}
+}
+
 const cursor_hidden = -1
 
 func (t *Termbox) is_cursor_hidden(x, y int) bool {
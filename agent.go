@@ -0,0 +1,58 @@
+package sshterm
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrNoAgent is returned by Session.Agent if the client has not forwarded
+// its agent.
+var ErrNoAgent = errors.New("sshterm: agent forwarding not requested")
+
+// sessionAgent is a session's forwarded agent.
+type sessionAgent struct {
+	requested bool
+	ch        ssh.Channel
+	client    agent.ExtendedAgent
+}
+
+func (s *Session) requestAgent() {
+	s.agentMu.Lock()
+	s.agent.requested = true
+	s.agentMu.Unlock()
+}
+
+// Agent returns the client's forwarded SSH agent, as with ssh -A, so the
+// handler can sign with the user's keys. The agent is reached over a single
+// channel for the lifetime of the session.
+func (s *Session) Agent() (agent.ExtendedAgent, error) {
+	s.agentMu.Lock()
+	defer s.agentMu.Unlock()
+	// Under RequireLogin the agent is only reachable once logged in, even
+	// though OpenSSH asks for it before the login screen is shown.
+	if !s.agent.requested || s.server.loginPending(s.conn) {
+		return nil, ErrNoAgent
+	}
+	if s.agent.client == nil {
+		ch, reqs, err := s.conn.OpenChannel("auth-agent@openssh.com", nil)
+		if err != nil {
+			return nil, err
+		}
+		go ssh.DiscardRequests(reqs)
+		s.agent.ch = ch
+		s.agent.client = agent.NewClient(ch)
+	}
+	return s.agent.client, nil
+}
+
+// closeAgent closes the channel to the session's agent, if one was opened.
+func (s *Session) closeAgent() {
+	s.agentMu.Lock()
+	defer s.agentMu.Unlock()
+	if s.agent.ch != nil {
+		s.agent.ch.Close()
+	}
+	s.agent = sessionAgent{}
+}
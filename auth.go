@@ -0,0 +1,485 @@
+package sshterm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// Permission extensions set by the authentication providers. The handler can
+// read them from Session.Conn().Permissions.Extensions.
+const (
+	// ExtAuthMethod is the method the user authenticated with, "publickey"
+	// or "password", or "none" if they were admitted by
+	// ssh.ServerConfig.NoClientAuth.
+	ExtAuthMethod = "sshterm-auth-method"
+	// ExtAuthSource is the file the credential was found in, or "memory".
+	ExtAuthSource = "sshterm-auth-source"
+	// ExtKeyFingerprint is the SHA256 fingerprint of the accepted key.
+	ExtKeyFingerprint = "sshterm-key-fingerprint"
+	// ExtKeyComment is the comment of the accepted authorized_keys entry.
+	ExtKeyComment = "sshterm-key-comment"
+)
+
+// dummyHash is compared against when a user is unknown, so that unknown and
+// known users take the same time to reject.
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+func compareDummyHash(pass []byte) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("sshterm"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, pass)
+}
+
+// watchedFile holds the parsed contents of a file, re-reading it when its
+// modification time or size changes. If the file can no longer be read its
+// contents are dropped, as removing it is a way to revoke access. If it no
+// longer parses, the failure is reported and the previous contents are kept.
+type watchedFile struct {
+	path   string
+	parse  func(data []byte) (interface{}, error)
+	report func(err error)
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	size    int64
+	value   interface{}
+	err     error
+}
+
+// statInterval bounds how often a watched file is stat'ed.
+var statInterval = time.Second
+
+func (f *watchedFile) get() (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checked) < statInterval && (f.value != nil || f.err != nil) {
+		return f.value, f.err
+	}
+	f.checked = time.Now()
+	fi, err := os.Stat(f.path)
+	if err == nil && (f.value != nil || f.err != nil) && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.value, f.err
+	}
+	var data []byte
+	if err == nil {
+		data, err = os.ReadFile(f.path)
+	}
+	if err != nil {
+		f.value, f.err = nil, err
+		f.modTime, f.size = time.Time{}, 0
+		return nil, err
+	}
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	v, err := f.parse(data)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", f.path, err)
+		if f.report != nil {
+			f.report(err)
+		}
+		if f.value == nil {
+			f.err = err
+		}
+		return f.value, f.err
+	}
+	f.value, f.err = v, nil
+	return v, nil
+}
+
+// Restrictions set by the options of an authorized_keys entry and honoured
+// by TermServer. They are present in Permissions.Extensions, with an empty
+// value, when they apply.
+const (
+	// ExtNoPTY refuses pty requests, so the Handler is not started.
+	ExtNoPTY = "sshterm-no-pty"
+	// ExtNoPortForwarding refuses direct-tcpip channels and tcpip-forward
+	// requests.
+	ExtNoPortForwarding = "sshterm-no-port-forwarding"
+	// ExtNoAgentForwarding refuses agent forwarding.
+	ExtNoAgentForwarding = "sshterm-no-agent-forwarding"
+)
+
+type authorizedKey struct {
+	key     ssh.PublicKey
+	comment string
+	// from is the from= pattern list, if any.
+	from string
+	// expiry is the expiry-time= option, if any.
+	expiry time.Time
+	// restrictions are the Ext* restrictions that apply.
+	restrictions map[string]bool
+	// err is set if the entry has options that cannot be honoured, in
+	// which case the key is refused.
+	err error
+}
+
+// keyOptionRestrictions maps the authorized_keys options that restrict a key
+// to the restriction they set. "restrict" sets all of them, and the options
+// that lift them are the same without the "no-" prefix.
+var keyOptionRestrictions = map[string]string{
+	"no-pty":              ExtNoPTY,
+	"no-port-forwarding":  ExtNoPortForwarding,
+	"no-agent-forwarding": ExtNoAgentForwarding,
+	// Neither is ever supported, so there is nothing to restrict.
+	"no-X11-forwarding": "",
+	"no-user-rc":        "",
+}
+
+func newAuthorizedKey(key ssh.PublicKey, comment string, options []string) authorizedKey {
+	ak := authorizedKey{key: key, comment: comment, restrictions: map[string]bool{}}
+	lifted := map[string]bool{}
+	for _, opt := range options {
+		name, value := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			name, value = opt[:i], strings.ReplaceAll(strings.Trim(opt[i+1:], `"`), `\"`, `"`)
+		}
+		switch name {
+		case "from":
+			ak.from = value
+		case "expiry-time":
+			expiry, err := parseExpiryTime(value)
+			if err != nil {
+				ak.err = err
+				return ak
+			}
+			ak.expiry = expiry
+		case "restrict":
+			for _, ext := range keyOptionRestrictions {
+				if ext != "" {
+					ak.restrictions[ext] = true
+				}
+			}
+		default:
+			if ext, ok := keyOptionRestrictions[name]; ok {
+				if ext != "" {
+					ak.restrictions[ext] = true
+				}
+			} else if ext, ok := keyOptionRestrictions["no-"+name]; ok {
+				if ext != "" {
+					lifted[ext] = true
+				}
+			} else {
+				ak.err = fmt.Errorf("unsupported authorized_keys option %q", name)
+				return ak
+			}
+		}
+	}
+	for ext := range lifted {
+		delete(ak.restrictions, ext)
+	}
+	return ak
+}
+
+// parseExpiryTime parses the YYYYMMDD[HHMM[SS]] timestamp of an expiry-time
+// option, in local time unless followed by "Z".
+func parseExpiryTime(s string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(s, "Z") {
+		s, loc = s[:len(s)-1], time.UTC
+	}
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(s) == len(layout) {
+			return time.ParseInLocation(layout, s, loc)
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", s)
+}
+
+// matchFrom reports whether the address host matches the pattern list of a
+// from= option. As with OpenSSH's UseDNS no, only addresses are matched, by
+// CIDR or by wildcard pattern, and a matching negated pattern refuses the
+// host outright.
+func matchFrom(patterns, host string) bool {
+	ip := net.ParseIP(host)
+	matched := false
+	for _, p := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		var ok bool
+		if _, ipnet, err := net.ParseCIDR(p); err == nil {
+			ok = ip != nil && ipnet.Contains(ip)
+		} else {
+			ok, _ = path.Match(p, host)
+		}
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// check reports whether the entry admits a connection from addr.
+func (ak *authorizedKey) check(addr net.Addr) error {
+	if ak.err != nil {
+		return ak.err
+	}
+	if !ak.expiry.IsZero() && time.Now().After(ak.expiry) {
+		return fmt.Errorf("key expired at %s", ak.expiry)
+	}
+	if ak.from != "" && !matchFrom(ak.from, hostOf(addr)) {
+		return fmt.Errorf("key not allowed from %s", hostOf(addr))
+	}
+	return nil
+}
+
+func parseAuthorizedKeys(data []byte) (interface{}, error) {
+	var keys []authorizedKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// ParseAuthorizedKey skips lines it cannot parse itself, so an
+			// error here means no further keys were found.
+			break
+		}
+		keys = append(keys, newAuthorizedKey(key, comment, options))
+		data = rest
+	}
+	return keys, nil
+}
+
+// AuthorizedKeys authenticates users against OpenSSH authorized_keys files.
+// Files are re-read when they change.
+//
+// The from= and expiry-time= options are enforced, and restrict, no-pty,
+// no-port-forwarding and no-agent-forwarding (and the options lifting them)
+// are passed on to TermServer as the ExtNo* extensions. Keys with any other
+// option, such as command= or permitopen=, are refused.
+type AuthorizedKeys struct {
+	// Logger receives failures to reload a file. If nil, slog.Default() is
+	// used.
+	Logger *slog.Logger
+
+	path func(user string) string
+
+	mu    sync.Mutex
+	files map[string]*watchedFile
+}
+
+// NewAuthorizedKeys returns an AuthorizedKeys that admits the keys in a single
+// file as any user.
+func NewAuthorizedKeys(path string) *AuthorizedKeys {
+	return NewUserAuthorizedKeys(func(string) string { return path })
+}
+
+// NewUserAuthorizedKeys returns an AuthorizedKeys that admits each user with
+// the keys in the file returned by path. An empty path rejects the user.
+func NewUserAuthorizedKeys(path func(user string) string) *AuthorizedKeys {
+	return &AuthorizedKeys{
+		path:  path,
+		files: map[string]*watchedFile{},
+	}
+}
+
+func (a *AuthorizedKeys) file(path string) *watchedFile {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, ok := a.files[path]
+	if !ok {
+		f = &watchedFile{path: path, parse: parseAuthorizedKeys, report: a.reloadFailed}
+		a.files[path] = f
+	}
+	return f
+}
+
+// PublicKeyCallback can be used as ssh.ServerConfig.PublicKeyCallback.
+func (a *AuthorizedKeys) PublicKeyCallback(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	user, _ := SplitUser(c.User())
+	path := a.path(user)
+	if path == "" {
+		return nil, fmt.Errorf("no authorized keys for %q", c.User())
+	}
+	v, err := a.file(path).get()
+	if err != nil {
+		return nil, err
+	}
+	marshaled := key.Marshal()
+	for _, ak := range v.([]authorizedKey) {
+		if !bytes.Equal(ak.key.Marshal(), marshaled) {
+			continue
+		}
+		if err := ak.check(c.RemoteAddr()); err != nil {
+			return nil, fmt.Errorf("public key rejected for %q: %w", c.User(), err)
+		}
+		perms := &ssh.Permissions{
+			Extensions: map[string]string{
+				ExtAuthMethod:     "publickey",
+				ExtAuthSource:     path,
+				ExtKeyFingerprint: ssh.FingerprintSHA256(key),
+				ExtKeyComment:     ak.comment,
+			},
+		}
+		for ext := range ak.restrictions {
+			perms.Extensions[ext] = ""
+		}
+		return perms, nil
+	}
+	return nil, fmt.Errorf("public key rejected for %q", c.User())
+}
+
+func (a *AuthorizedKeys) reloadFailed(err error) {
+	reportReloadFailure(a.Logger, err)
+}
+
+// reportReloadFailure logs that a watched file could not be reloaded.
+func reportReloadFailure(l *slog.Logger, err error) {
+	if l == nil {
+		l = slog.Default()
+	}
+	l.Warn("sshterm: keeping previous contents", slog.Any("err", err))
+}
+
+func parsePasswordFile(data []byte) (interface{}, error) {
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		i := bytes.IndexByte(text, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected user:hash", line)
+		}
+		users[string(text[:i])] = append([]byte(nil), text[i+1:]...)
+	}
+	return users, scanner.Err()
+}
+
+// PasswordFile authenticates users against an htpasswd style file of
+// "user:bcrypt-hash" lines. The file is re-read when it changes.
+type PasswordFile struct {
+	// Logger receives failures to reload the file. If nil, slog.Default()
+	// is used.
+	Logger *slog.Logger
+
+	file *watchedFile
+}
+
+// NewPasswordFile returns a PasswordFile reading from path.
+func NewPasswordFile(path string) *PasswordFile {
+	p := &PasswordFile{}
+	p.file = &watchedFile{path: path, parse: parsePasswordFile, report: func(err error) {
+		reportReloadFailure(p.Logger, err)
+	}}
+	return p
+}
+
+// PasswordCallback can be used as ssh.ServerConfig.PasswordCallback.
+func (p *PasswordFile) PasswordCallback(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	v, err := p.file.get()
+	if err != nil {
+		return nil, err
+	}
+	user, _ := SplitUser(c.User())
+	hash, ok := v.(map[string][]byte)[user]
+	if !ok {
+		compareDummyHash(pass)
+		return nil, fmt.Errorf("password rejected for %q", c.User())
+	}
+	if bcrypt.CompareHashAndPassword(hash, pass) != nil {
+		return nil, fmt.Errorf("password rejected for %q", c.User())
+	}
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			ExtAuthMethod: "password",
+			ExtAuthSource: p.file.path,
+		},
+	}, nil
+}
+
+// MemoryAuth authenticates users against passwords and keys held in memory.
+// It is safe to change them while the server is running.
+type MemoryAuth struct {
+	mu        sync.RWMutex
+	passwords map[string][]byte
+	keys      map[string][]ssh.PublicKey
+}
+
+// NewMemoryAuth returns an empty MemoryAuth.
+func NewMemoryAuth() *MemoryAuth {
+	return &MemoryAuth{
+		passwords: map[string][]byte{},
+		keys:      map[string][]ssh.PublicKey{},
+	}
+}
+
+// SetPassword sets the password of user. An empty password removes it.
+func (m *MemoryAuth) SetPassword(user, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if password == "" {
+		delete(m.passwords, user)
+		return
+	}
+	m.passwords[user] = []byte(password)
+}
+
+// AddKey authorizes key for user.
+func (m *MemoryAuth) AddKey(user string, key ssh.PublicKey) {
+	m.mu.Lock()
+	m.keys[user] = append(m.keys[user], key)
+	m.mu.Unlock()
+}
+
+// RemoveUser removes all credentials of user.
+func (m *MemoryAuth) RemoveUser(user string) {
+	m.mu.Lock()
+	delete(m.passwords, user)
+	delete(m.keys, user)
+	m.mu.Unlock()
+}
+
+// PasswordCallback can be used as ssh.ServerConfig.PasswordCallback.
+func (m *MemoryAuth) PasswordCallback(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	user, _ := SplitUser(c.User())
+	m.mu.RLock()
+	want, ok := m.passwords[user]
+	m.mu.RUnlock()
+	if !ok || subtle.ConstantTimeCompare(want, pass) != 1 {
+		return nil, fmt.Errorf("password rejected for %q", c.User())
+	}
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			ExtAuthMethod: "password",
+			ExtAuthSource: "memory",
+		},
+	}, nil
+}
+
+// PublicKeyCallback can be used as ssh.ServerConfig.PublicKeyCallback.
+func (m *MemoryAuth) PublicKeyCallback(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	user, _ := SplitUser(c.User())
+	m.mu.RLock()
+	keys := m.keys[user]
+	m.mu.RUnlock()
+	marshaled := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), marshaled) {
+			return &ssh.Permissions{
+				Extensions: map[string]string{
+					ExtAuthMethod:     "publickey",
+					ExtAuthSource:     "memory",
+					ExtKeyFingerprint: ssh.FingerprintSHA256(key),
+				},
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("public key rejected for %q", c.User())
+}
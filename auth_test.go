@@ -0,0 +1,239 @@
+package sshterm
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+type testConnMetadata struct {
+	user string
+	addr net.Addr
+}
+
+func (m testConnMetadata) User() string          { return m.user }
+func (m testConnMetadata) SessionID() []byte     { return nil }
+func (m testConnMetadata) ClientVersion() []byte { return nil }
+func (m testConnMetadata) ServerVersion() []byte { return nil }
+func (m testConnMetadata) RemoteAddr() net.Addr  { return m.addr }
+func (m testConnMetadata) LocalAddr() net.Addr   { return m.addr }
+
+func testMetadata(user string) ssh.ConnMetadata {
+	return testConnMetadata{user, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}}
+}
+
+func testPublicKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// reloadNow makes watched files re-read on every lookup.
+func reloadNow(t *testing.T) {
+	interval := statInterval
+	statInterval = 0
+	t.Cleanup(func() { statInterval = interval })
+}
+
+func writeFile(t *testing.T, path, data string) {
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthorizedKeysReload(t *testing.T) {
+	reloadNow(t)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	key1, key2 := testPublicKey(t), testPublicKey(t)
+	a := NewAuthorizedKeys(path)
+	c := testMetadata("alice")
+
+	writeFile(t, path, string(ssh.MarshalAuthorizedKey(key1)))
+	perms, err := a.PublicKeyCallback(c, key1)
+	if err != nil {
+		t.Fatalf("key1 rejected: %v", err)
+	}
+	if perms.Extensions[ExtAuthSource] != path {
+		t.Errorf("auth source = %q, want %q", perms.Extensions[ExtAuthSource], path)
+	}
+	if _, err := a.PublicKeyCallback(c, key2); err == nil {
+		t.Error("key2 accepted before it was added")
+	}
+
+	writeFile(t, path, string(ssh.MarshalAuthorizedKey(key2))+"# rotated\n")
+	if _, err := a.PublicKeyCallback(c, key2); err != nil {
+		t.Errorf("key2 rejected after reload: %v", err)
+	}
+	if _, err := a.PublicKeyCallback(c, key1); err == nil {
+		t.Error("key1 accepted after it was removed")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.PublicKeyCallback(c, key2); err == nil {
+		t.Error("key2 accepted after the file was removed")
+	}
+}
+
+func TestAuthorizedKeysOptions(t *testing.T) {
+	reloadNow(t)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	key := testPublicKey(t)
+	line := string(ssh.MarshalAuthorizedKey(key))
+	c := testMetadata("alice")
+
+	tests := []struct {
+		options string
+		ok      bool
+		exts    []string
+	}{
+		{`from="127.0.0.1"`, true, nil},
+		{`from="10.0.0.0/8,192.168.*"`, false, nil},
+		{`from="127.0.0.0/8,!127.0.0.1"`, false, nil},
+		{`from="10.*,127.0.0.?"`, true, nil},
+		{`expiry-time="20000101"`, false, nil},
+		{`expiry-time="29991231235959Z"`, true, nil},
+		{`restrict`, true, []string{ExtNoPTY, ExtNoPortForwarding, ExtNoAgentForwarding}},
+		{`restrict,pty`, true, []string{ExtNoPortForwarding, ExtNoAgentForwarding}},
+		{`no-agent-forwarding,no-X11-forwarding`, true, []string{ExtNoAgentForwarding}},
+		{`command="/bin/false"`, false, nil},
+		{`permitopen="localhost:80"`, false, nil},
+	}
+	for _, test := range tests {
+		a := NewAuthorizedKeys(path)
+		writeFile(t, path, test.options+" "+line)
+		perms, err := a.PublicKeyCallback(c, key)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.options, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for _, ext := range []string{ExtNoPTY, ExtNoPortForwarding, ExtNoAgentForwarding} {
+			_, got := perms.Extensions[ext]
+			want := false
+			for _, e := range test.exts {
+				want = want || e == ext
+			}
+			if got != want {
+				t.Errorf("%s: %s set = %v, want %v", test.options, ext, got, want)
+			}
+		}
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	reloadNow(t)
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	hash := func(pass string) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(h)
+	}
+	p := NewPasswordFile(path)
+	c := testMetadata("alice")
+
+	writeFile(t, path, "# users\nalice:"+hash("secret")+"\n")
+	if _, err := p.PasswordCallback(c, []byte("secret")); err != nil {
+		t.Errorf("password rejected: %v", err)
+	}
+	if _, err := p.PasswordCallback(c, []byte("wrong")); err == nil {
+		t.Error("wrong password accepted")
+	}
+	if _, err := p.PasswordCallback(testMetadata("bob"), []byte("secret")); err == nil {
+		t.Error("unknown user accepted")
+	}
+	if _, err := p.PasswordCallback(testMetadata("alice+admin"), []byte("secret")); err != nil {
+		t.Errorf("password rejected for alice+admin: %v", err)
+	}
+
+	writeFile(t, path, "alice:"+hash("changed")+"\n")
+	if _, err := p.PasswordCallback(c, []byte("changed")); err != nil {
+		t.Errorf("new password rejected after reload: %v", err)
+	}
+	if _, err := p.PasswordCallback(c, []byte("secret")); err == nil {
+		t.Error("old password accepted after reload")
+	}
+
+	// A file that no longer parses keeps the previous contents.
+	writeFile(t, path, "not a password file\n")
+	if _, err := p.PasswordCallback(c, []byte("changed")); err != nil {
+		t.Errorf("password rejected after a failed reload: %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.PasswordCallback(c, []byte("changed")); err == nil {
+		t.Error("password accepted after the file was removed")
+	}
+}
+
+func TestMemoryAuth(t *testing.T) {
+	m := NewMemoryAuth()
+	c := testMetadata("alice")
+	key := testPublicKey(t)
+
+	if _, err := m.PasswordCallback(c, []byte("")); err == nil {
+		t.Error("empty password accepted for a user without one")
+	}
+	m.SetPassword("alice", "secret")
+	m.AddKey("alice", key)
+	if _, err := m.PasswordCallback(c, []byte("secret")); err != nil {
+		t.Errorf("password rejected: %v", err)
+	}
+	if _, err := m.PasswordCallback(c, []byte("wrong")); err == nil {
+		t.Error("wrong password accepted")
+	}
+	if _, err := m.PublicKeyCallback(c, key); err != nil {
+		t.Errorf("key rejected: %v", err)
+	}
+	if _, err := m.PublicKeyCallback(testMetadata("bob"), key); err == nil {
+		t.Error("alice's key accepted for bob")
+	}
+	// "user+app" names authenticate as the user.
+	if _, err := m.PublicKeyCallback(testMetadata("alice+admin"), key); err != nil {
+		t.Errorf("key rejected for alice+admin: %v", err)
+	}
+	if _, err := m.PasswordCallback(testMetadata("alice+admin"), []byte("secret")); err != nil {
+		t.Errorf("password rejected for alice+admin: %v", err)
+	}
+
+	m.RemoveUser("alice")
+	if _, err := m.PasswordCallback(c, []byte("secret")); err == nil {
+		t.Error("password accepted after RemoveUser")
+	}
+	if _, err := m.PublicKeyCallback(c, key); err == nil {
+		t.Error("key accepted after RemoveUser")
+	}
+}
+
+func TestParseExpiryTime(t *testing.T) {
+	got, err := parseExpiryTime("202401021504Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if _, err := parseExpiryTime("2024"); err == nil {
+		t.Error("short timestamp accepted")
+	}
+}
@@ -0,0 +1,96 @@
+package sshterm
+
+import (
+	"strings"
+	"text/template"
+
+	"golang.org/x/crypto/ssh"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// BannerData is the data a banner set with SetBanner is executed with.
+type BannerData struct {
+	User          string
+	RemoteAddr    string
+	LocalAddr     string
+	ClientVersion string
+	ServerVersion string
+}
+
+// SetBanner sets a banner shown to clients before they authenticate. text is
+// a text/template executed with a BannerData. The banner is installed as
+// Config.BannerCallback by Listen, unless that is already set. It returns an
+// error if text does not parse.
+func (ts *TermServer) SetBanner(text string) error {
+	tmpl, err := template.New("banner").Parse(text)
+	if err != nil {
+		return err
+	}
+	ts.banner = func(conn ssh.ConnMetadata) string {
+		var b strings.Builder
+		err := tmpl.Execute(&b, BannerData{
+			User:          conn.User(),
+			RemoteAddr:    conn.RemoteAddr().String(),
+			LocalAddr:     conn.LocalAddr().String(),
+			ClientVersion: string(conn.ClientVersion()),
+			ServerVersion: string(conn.ServerVersion()),
+		})
+		if err != nil {
+			b.Reset()
+			b.WriteString(text)
+		}
+		// SSH clients print the banner verbatim.
+		return strings.ReplaceAll(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n", "\r\n")
+	}
+	return nil
+}
+
+// MOTD shows a message of the day after login, before the handler runs. The
+// user dismisses it with any key. text is a text/template executed with the
+// Session, so e.g. {{.User}} can be used. It returns an error if text does
+// not parse.
+func MOTD(text string) (Middleware, error) {
+	tmpl, err := template.New("motd").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return func(next Handler) Handler {
+		return func(t *tb.Termbox, s *Session) Term {
+			var b strings.Builder
+			if err := tmpl.Execute(&b, s); err != nil {
+				b.Reset()
+				b.WriteString(text)
+			}
+			lines := strings.Split(strings.TrimRight(b.String(), "\n"), "\n")
+			return gate(t, s, func() bool { return showMOTD(t, s, lines) }, next)
+		}
+	}, nil
+}
+
+func showMOTD(t *tb.Termbox, s *Session, lines []string) bool {
+	const fg, bg = tb.ColorDefault, tb.ColorDefault
+	for {
+		t.Clear(fg, bg)
+		_, h := t.Size()
+		for y, line := range lines {
+			if y >= h-2 {
+				break
+			}
+			drawText(t, 1, y+1, strings.TrimRight(line, "\r"), fg, bg)
+		}
+		drawText(t, 1, h-1, "Press any key to continue", fg|tb.AttrReverse, bg)
+		t.Flush()
+
+		ev := t.PollEventWithContext(s.Context())
+		switch ev.Type {
+		case tb.EventKey, tb.EventMouse:
+			if ev.Type == tb.EventMouse && ev.Key == tb.MouseRelease {
+				continue
+			}
+			return true
+		case tb.EventError, tb.EventCancel:
+			return false
+		}
+	}
+}
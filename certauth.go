@@ -0,0 +1,147 @@
+package sshterm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Permission extensions set by CertAuth, alongside the certificate's own
+// extensions.
+const (
+	// ExtCertKeyID is the key ID of the accepted certificate.
+	ExtCertKeyID = "sshterm-cert-key-id"
+	// ExtCertSerial is the serial number of the accepted certificate.
+	ExtCertSerial = "sshterm-cert-serial"
+)
+
+// CertAuth authenticates users presenting OpenSSH user certificates signed by
+// one of its certificate authorities.
+type CertAuth struct {
+	// CAKeys are the trusted certificate authorities.
+	CAKeys []ssh.PublicKey
+	// Principals returns the principals accepted for a user, any one of
+	// which must be listed in the certificate. If nil, the certificate must
+	// list the user's name.
+	Principals func(user string) []string
+	// SupportedCriticalOptions lists the critical options the application
+	// enforces itself. Certificates with other critical options are
+	// rejected. "source-address" is always enforced.
+	SupportedCriticalOptions []string
+	// IsRevoked, if set, reports whether a certificate has been revoked.
+	IsRevoked func(cert *ssh.Certificate) bool
+	// Clock returns the time certificates are validated against. If nil,
+	// time.Now is used.
+	Clock func() time.Time
+	// Fallback, if set, handles keys that are not certificates.
+	Fallback func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+}
+
+func (a *CertAuth) isAuthority(key ssh.PublicKey) bool {
+	marshaled := key.Marshal()
+	for _, ca := range a.CAKeys {
+		if bytes.Equal(ca.Marshal(), marshaled) {
+			return true
+		}
+	}
+	return false
+}
+
+// principal returns the certificate principal that admits user.
+func (a *CertAuth) principal(user string, cert *ssh.Certificate) (string, error) {
+	allowed := []string{user}
+	if a.Principals != nil {
+		allowed = a.Principals(user)
+	}
+	for _, want := range allowed {
+		for _, p := range cert.ValidPrincipals {
+			if p == want {
+				return p, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("certificate principals %q do not admit %q", cert.ValidPrincipals, user)
+}
+
+// PublicKeyCallback can be used as ssh.ServerConfig.PublicKeyCallback.
+func (a *CertAuth) PublicKeyCallback(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		if a.Fallback != nil {
+			return a.Fallback(c, key)
+		}
+		return nil, errors.New("only certificates are accepted")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate has type %d, not a user certificate", cert.CertType)
+	}
+	if !a.isAuthority(cert.SignatureKey) {
+		return nil, errors.New("certificate signed by unrecognized authority")
+	}
+	// Empty ValidPrincipals would admit every user to CertChecker, so the
+	// principal is matched here and the matching one passed on.
+	user, _ := SplitUser(c.User())
+	principal, err := a.principal(user, cert)
+	if err != nil {
+		return nil, err
+	}
+	// CheckCert only accepts the critical options it is told about, and the
+	// server enforces source-address on the returned permissions.
+	checker := &ssh.CertChecker{
+		SupportedCriticalOptions: append(slices.Clip(a.SupportedCriticalOptions), "source-address"),
+		IsRevoked:                a.IsRevoked,
+		Clock:                    a.Clock,
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return nil, err
+	}
+
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	for k, v := range cert.CriticalOptions {
+		perms.CriticalOptions[k] = v
+	}
+	for k, v := range cert.Extensions {
+		perms.Extensions[k] = v
+	}
+	perms.Extensions[ExtAuthMethod] = "publickey"
+	perms.Extensions[ExtKeyFingerprint] = ssh.FingerprintSHA256(cert.Key)
+	perms.Extensions[ExtCertKeyID] = cert.KeyId
+	perms.Extensions[ExtCertSerial] = strconv.FormatUint(cert.Serial, 10)
+	return perms, nil
+}
+
+// CertKeyID returns the key ID of the certificate the user authenticated
+// with, or "" if CertAuth did not authenticate them.
+func (s *Session) CertKeyID() string {
+	if s.conn == nil || s.conn.Permissions == nil {
+		return ""
+	}
+	return s.conn.Permissions.Extensions[ExtCertKeyID]
+}
+
+// CertExtensions returns the extensions of the certificate the user
+// authenticated with, such as "permit-port-forwarding".
+func (s *Session) CertExtensions() map[string]string {
+	ext := map[string]string{}
+	if s.conn == nil || s.conn.Permissions == nil {
+		return ext
+	}
+	if _, ok := s.conn.Permissions.Extensions[ExtCertSerial]; !ok {
+		return ext
+	}
+	for k, v := range s.conn.Permissions.Extensions {
+		if !strings.HasPrefix(k, "sshterm-") {
+			ext[k] = v
+		}
+	}
+	return ext
+}
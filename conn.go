@@ -0,0 +1,297 @@
+package sshterm
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// Conn is a single authenticated SSH connection. A client may multiplex
+// several sessions over one connection (e.g. OpenSSH's ControlMaster), all of
+// which share the same Conn.
+type Conn struct {
+	*ssh.ServerConn
+
+	// Data is free for the application to use for per-connection state. It is
+	// typically set in OnConnect and read by every session on the connection.
+	Data interface{}
+
+	mu       sync.Mutex
+	sessions []*Session
+	reserved int
+	// noMore signals a no-more-sessions@openssh.com request to
+	// handleChannels.
+	noMore chan struct{}
+	// wg tracks the goroutines handling the connection's channels, so
+	// OnDisconnect can wait for them.
+	wg sync.WaitGroup
+	// login is the Identity established by an in-session login on one of
+	// the connection's sessions, if any.
+	login string
+	// forwards are the remote forwards by "host:port", with their listener
+	// unless they are virtual.
+	forwards map[string]net.Listener
+}
+
+func newConn(sshConn *ssh.ServerConn) *Conn {
+	return &Conn{
+		ServerConn: sshConn,
+		noMore:     make(chan struct{}, 1),
+	}
+}
+
+// Sessions returns the sessions currently open on the connection.
+func (c *Conn) Sessions() []*Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sessions := make([]*Session, len(c.sessions))
+	copy(sessions, c.sessions)
+	return sessions
+}
+
+// reserveSession reserves room for a session, unless max sessions (if
+// positive) are already open or being opened.
+func (c *Conn) reserveSession(max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.reserved >= max {
+		return false
+	}
+	c.reserved++
+	return true
+}
+
+// setNoMoreSessions records a no-more-sessions@openssh.com request, after
+// which no further sessions may be opened.
+func (c *Conn) setNoMoreSessions() {
+	select {
+	case c.noMore <- struct{}{}:
+	default:
+	}
+}
+
+// setLogin records the Identity established by an in-session login, which
+// lifts TermServer.RequireLogin for the connection and is inherited by its
+// later sessions.
+func (c *Conn) setLogin(identity string) {
+	c.mu.Lock()
+	c.login = identity
+	c.mu.Unlock()
+}
+
+func (c *Conn) loginIdentity() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.login
+}
+
+// restricted reports whether the connection's key carries the restriction
+// ext, one of the ExtNo* extensions.
+func (c *Conn) restricted(ext string) bool {
+	if c.Permissions == nil {
+		return false
+	}
+	_, ok := c.Permissions.Extensions[ext]
+	return ok
+}
+
+func (c *Conn) releaseSession() {
+	c.mu.Lock()
+	c.reserved--
+	c.mu.Unlock()
+}
+
+func (c *Conn) addSession(s *Session) {
+	c.mu.Lock()
+	c.sessions = append(c.sessions, s)
+	c.mu.Unlock()
+}
+
+func (c *Conn) removeSession(s *Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, cs := range c.sessions {
+		if cs == s {
+			c.sessions = append(c.sessions[:i], c.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Session is a single "session" channel on a Conn, or a terminal served by
+// one of the other front ends such as WebGateway.
+type Session struct {
+	server   *TermServer
+	conn     *Conn
+	ch       io.ReadWriteCloser
+	user     string
+	remote   net.Addr
+	term     string
+	identity string
+	// login is set if identity was established by an in-session login.
+	login bool
+	// verified is set if the transport authenticated the user name.
+	verified bool
+	env      []string
+
+	bytesIn  int64
+	bytesOut int64
+
+	// onExit, if set, intercepts the next Exit or Close, e.g. to return to a
+	// Launcher instead of ending the session.
+	exitMu sync.Mutex
+	onExit func(code int)
+
+	agentMu sync.Mutex
+	agent   sessionAgent
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newSession(ts *TermServer, conn *Conn, ch ssh.Channel) *Session {
+	s := newTransportSession(ts, conn.User(), conn.RemoteAddr(), ch)
+	s.conn = conn
+	s.verified = conn.Permissions == nil || conn.Permissions.Extensions[ExtAuthMethod] != "none"
+	if identity := conn.loginIdentity(); identity != "" {
+		s.identity, s.login = identity, true
+	}
+	return s
+}
+
+// newTransportSession creates a session that is not on an SSH connection.
+// Closing ch ends it.
+func newTransportSession(ts *TermServer, user string, remote net.Addr, ch io.ReadWriteCloser) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		server: ts,
+		ch:     ch,
+		user:   user,
+		remote: remote,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Conn returns the connection the session belongs to, or nil if the session
+// is not served over SSH.
+func (s *Session) Conn() *Conn {
+	return s.conn
+}
+
+// User returns the name the client authenticated as.
+func (s *Session) User() string {
+	return s.user
+}
+
+// Identity returns the identity established by an in-session login such as
+// LoginScreen, or the SSH user name if there was none.
+func (s *Session) Identity() string {
+	if s.identity != "" {
+		return s.identity
+	}
+	return s.User()
+}
+
+// Authenticated reports whether Identity has been verified, by SSH
+// authentication other than NoClientAuth, by WebGateway.User or by an
+// in-session login such as LoginScreen.
+func (s *Session) Authenticated() bool {
+	return s.login || s.verified
+}
+
+// setLogin records the identity established by an in-session login.
+func (s *Session) setLogin(identity string) {
+	s.identity, s.login = identity, true
+	if s.conn != nil {
+		s.conn.setLogin(identity)
+	}
+}
+
+// RemoteAddr returns the address of the client.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+// Term returns the TERM value the client sent in its pty request.
+func (s *Session) Term() string {
+	return s.term
+}
+
+// Env returns the environment variables the client sent, as "NAME=value"
+// strings.
+func (s *Session) Env() []string {
+	env := make([]string, len(s.env))
+	copy(env, s.env)
+	return env
+}
+
+// Context returns a context that is cancelled once the session's channel has
+// been closed, by either side.
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// goSafe runs f in a new goroutine, ending the session like a panicking
+// handler would if f panics.
+func (s *Session) goSafe(t *tb.Termbox, f func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				s.server.sessionPanic(s, t, r)
+			}
+		}()
+		f()
+	}()
+}
+
+type exitStatusMsg struct {
+	Status uint32
+}
+
+func (s *Session) setExitHook(f func(code int)) {
+	s.exitMu.Lock()
+	s.onExit = f
+	s.exitMu.Unlock()
+}
+
+func (s *Session) exitHook() func(code int) {
+	s.exitMu.Lock()
+	defer s.exitMu.Unlock()
+	f := s.onExit
+	s.onExit = nil
+	return f
+}
+
+// Exit sends the exit status to the client and closes the session. Within a
+// Launcher it returns to the launcher's menu instead. Clients not connected
+// over SSH are not told the exit status.
+func (s *Session) Exit(code int) error {
+	if f := s.exitHook(); f != nil {
+		f(code)
+		return nil
+	}
+	if ch, ok := s.ch.(ssh.Channel); ok {
+		_, err := ch.SendRequest("exit-status", false, ssh.Marshal(exitStatusMsg{uint32(code)}))
+		if err != nil {
+			s.ch.Close()
+			return err
+		}
+	}
+	return s.ch.Close()
+}
+
+// Close closes the session without sending an exit status. Within a
+// Launcher it returns to the launcher's menu instead.
+func (s *Session) Close() error {
+	if f := s.exitHook(); f != nil {
+		f(0)
+		return nil
+	}
+	return s.ch.Close()
+}
@@ -0,0 +1,44 @@
+package sshterm
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+)
+
+// acceptEnv reports whether the session may set env according to AcceptEnv
+// and the environment limits.
+func (ts *TermServer) acceptEnv(s *Session, env envVar) bool {
+	maxVars, maxSize := ts.MaxEnvVars, ts.MaxEnvSize
+	if maxVars <= 0 {
+		maxVars = 64
+	}
+	if maxSize <= 0 {
+		maxSize = 32 << 10
+	}
+	if !ts.envAllowed(env.Name) {
+		ts.reportError(slog.LevelDebug, ts.connError("env", s.conn, fmt.Errorf("rejected variable %q", env.Name)))
+		return false
+	}
+	size := len(env.Name) + len(env.Value) + 1
+	for _, kv := range s.env {
+		size += len(kv)
+	}
+	if len(s.env) >= maxVars || size > maxSize {
+		ts.reportError(slog.LevelWarn, ts.connError("env", s.conn, fmt.Errorf("environment limit exceeded by %q", env.Name)))
+		return false
+	}
+	return true
+}
+
+func (ts *TermServer) envAllowed(name string) bool {
+	if ts.AcceptEnv == nil {
+		return true
+	}
+	for _, pattern := range ts.AcceptEnv {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package sshterm
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHConn is an ssh.Conn with nothing but metadata.
+type testSSHConn struct {
+	ssh.Conn
+	md testConnMetadata
+}
+
+func (c testSSHConn) User() string          { return c.md.User() }
+func (c testSSHConn) SessionID() []byte     { return c.md.SessionID() }
+func (c testSSHConn) ClientVersion() []byte { return c.md.ClientVersion() }
+func (c testSSHConn) ServerVersion() []byte { return c.md.ServerVersion() }
+func (c testSSHConn) RemoteAddr() net.Addr  { return c.md.RemoteAddr() }
+func (c testSSHConn) LocalAddr() net.Addr   { return c.md.LocalAddr() }
+
+func TestAcceptEnv(t *testing.T) {
+	vars := func(n int) []string {
+		env := make([]string, n)
+		for i := range env {
+			env[i] = fmt.Sprintf("V%d=x", i)
+		}
+		return env
+	}
+	tests := []struct {
+		accept   []string
+		maxVars  int
+		maxSize  int
+		env      []string
+		name     string
+		value    string
+		accepted bool
+	}{
+		{nil, 0, 0, nil, "LANG", "C", true},
+		{[]string{"LANG", "LC_*"}, 0, 0, nil, "LANG", "C", true},
+		{[]string{"LANG", "LC_*"}, 0, 0, nil, "LC_ALL", "C", true},
+		{[]string{"LANG", "LC_*"}, 0, 0, nil, "PATH", "/bin", false},
+		{[]string{"LC_?"}, 0, 0, nil, "LC_AB", "C", false},
+		{[]string{}, 0, 0, nil, "LANG", "C", false},
+		{nil, 0, 0, vars(63), "LANG", "C", true},
+		{nil, 0, 0, vars(64), "LANG", "C", false},
+		{nil, 2, 0, vars(1), "LANG", "C", true},
+		{nil, 2, 0, vars(2), "LANG", "C", false},
+		{nil, 0, 20, []string{"A=1234567890"}, "B", "12345", true},
+		{nil, 0, 20, []string{"A=1234567890"}, "B", "123456789", false},
+		{nil, 0, 0, nil, "BIG", strings.Repeat("x", 32<<10), false},
+	}
+	for _, test := range tests {
+		ts := &TermServer{
+			Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+			AcceptEnv:  test.accept,
+			MaxEnvVars: test.maxVars,
+			MaxEnvSize: test.maxSize,
+		}
+		conn := newConn(&ssh.ServerConn{Conn: testSSHConn{md: testMetadata("alice").(testConnMetadata)}})
+		s := &Session{server: ts, conn: conn, env: test.env}
+		if got := ts.acceptEnv(s, envVar{test.name, test.value}); got != test.accepted {
+			t.Errorf("AcceptEnv %q, limits %d/%d, %d set: %s accepted = %v, want %v",
+				test.accept, test.maxVars, test.maxSize, len(test.env), test.name, got, test.accepted)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package sshterm
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// OpError is the error passed to TermServer.ErrorHandler. It describes the
+// operation that failed and what is known about the client at that point.
+type OpError struct {
+	// Op is the failed operation, such as "accept", "handshake", "channel",
+	// "request" or "init".
+	Op            string
+	RemoteAddr    net.Addr
+	ClientVersion string
+	User          string
+	Err           error
+}
+
+func (e *OpError) Error() string {
+	s := "sshterm: " + e.Op
+	if e.RemoteAddr != nil {
+		s += " " + e.RemoteAddr.String()
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+func (ts *TermServer) logger() *slog.Logger {
+	if ts.Logger != nil {
+		return ts.Logger
+	}
+	return slog.Default()
+}
+
+// reportError logs e at the given level and hands it to ErrorHandler.
+func (ts *TermServer) reportError(level slog.Level, e *OpError, args ...any) {
+	attrs := []any{slog.String("op", e.Op)}
+	if e.RemoteAddr != nil {
+		attrs = append(attrs, slog.String("remote_addr", e.RemoteAddr.String()))
+	}
+	if e.ClientVersion != "" {
+		attrs = append(attrs, slog.String("client_version", e.ClientVersion))
+	}
+	if e.User != "" {
+		attrs = append(attrs, slog.String("user", e.User))
+	}
+	attrs = append(attrs, args...)
+	attrs = append(attrs, slog.Any("err", e.Err))
+	ts.logger().Log(context.Background(), level, "sshterm: "+e.Op, attrs...)
+	if ts.ErrorHandler != nil {
+		ts.ErrorHandler(e)
+	}
+}
+
+func (ts *TermServer) connError(op string, c *Conn, err error) *OpError {
+	return &OpError{
+		Op:            op,
+		RemoteAddr:    c.RemoteAddr(),
+		ClientVersion: string(c.ClientVersion()),
+		User:          c.User(),
+		Err:           err,
+	}
+}
+
+// sessionError is connError for a session, which may not be on an SSH
+// connection.
+func (ts *TermServer) sessionError(op string, s *Session, err error) *OpError {
+	if s.conn != nil {
+		return ts.connError(op, s.conn, err)
+	}
+	return &OpError{
+		Op:         op,
+		RemoteAddr: s.RemoteAddr(),
+		User:       s.User(),
+		Err:        err,
+	}
+}
+
+// versionConn records the identification line the client sends at the start
+// of the handshake, so failed handshakes can still be reported with it.
+type versionConn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	line []byte
+	done bool
+}
+
+func (c *versionConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	if !c.done && n > 0 {
+		c.line = append(c.line, b[:n]...)
+		if i := bytes.IndexByte(c.line, '\n'); i >= 0 {
+			c.line = c.line[:i]
+			c.done = true
+		} else if len(c.line) > 255 {
+			c.done = true
+		}
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *versionConn) version() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done {
+		return ""
+	}
+	return string(bytes.TrimRight(c.line, "\r"))
+}
@@ -0,0 +1,361 @@
+package sshterm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// LocalForward configures the forwarding of direct-tcpip channels, as
+// opened by ssh -L.
+type LocalForward struct {
+	// Allow decides whether the connection may forward to host:port. If nil,
+	// only Virtual destinations may be reached.
+	Allow func(c *Conn, host string, port int) bool
+	// Virtual maps "host:port" destinations to in-process handlers, which
+	// are given the forwarded connection instead of dialing the network.
+	// ForwardListener adapts servers like http.Server to them.
+	Virtual map[string]func(conn net.Conn)
+	// Dial connects to network destinations. If nil, a net.Dialer with a 10
+	// second timeout is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type directTCPIPMsg struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+func (ts *TermServer) handleDirectTCPIP(newChannel ssh.NewChannel, conn *Conn) {
+	lf := ts.LocalForward
+	var msg directTCPIPMsg
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &msg); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		ts.reportError(slog.LevelWarn, ts.connError("forward", conn, fmt.Errorf("malformed direct-tcpip request: %w", err)))
+		return
+	}
+	addr := net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port)))
+	virtual, isVirtual := lf.Virtual[addr]
+	if !lf.permits(conn, msg.Host, int(msg.Port), isVirtual) {
+		newChannel.Reject(ssh.Prohibited, "forwarding to "+addr+" is not permitted")
+		ts.reportError(slog.LevelWarn, ts.connError("forward", conn, fmt.Errorf("denied forwarding to %s", addr)))
+		return
+	}
+
+	var target net.Conn
+	if isVirtual {
+		var local net.Conn
+		target, local = net.Pipe()
+		go virtual(local)
+	} else {
+		dial := lf.Dial
+		if dial == nil {
+			dial = (&net.Dialer{Timeout: 10 * time.Second}).DialContext
+		}
+		var err error
+		target, err = dial(context.Background(), "tcp", addr)
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			ts.reportError(slog.LevelWarn, ts.connError("forward", conn, err))
+			return
+		}
+	}
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	ts.proxy("local", conn, addr, ch, target)
+}
+
+// permits reports whether conn may forward to host:port, which is a Virtual
+// destination if virtual is set.
+func (lf *LocalForward) permits(conn *Conn, host string, port int, virtual bool) bool {
+	allowed := virtual && lf.Allow == nil
+	if lf.Allow != nil {
+		allowed = lf.Allow(conn, host, port)
+	}
+	return allowed && !conn.restricted(ExtNoPortForwarding)
+}
+
+// proxy copies data between ch and target until both directions are done,
+// then reports what was transferred.
+func (ts *TermServer) proxy(kind string, conn *Conn, addr string, ch ssh.Channel, target net.Conn) {
+	m := ts.metrics()
+	m.Counter(MetricForwards, "kind", kind).Add(1)
+	active := m.Gauge(MetricForwardsActive, "kind", kind)
+	active.Add(1)
+	defer active.Add(-1)
+
+	start := time.Now()
+	var in, out int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(countingWriter{target, &in}, ch)
+		if cw, ok := target.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			target.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(countingWriter{ch, &out}, target)
+		ch.CloseWrite()
+	}()
+	wg.Wait()
+	ch.Close()
+	target.Close()
+
+	m.Summary(MetricForwardBytesIn, "kind", kind).Observe(float64(atomic.LoadInt64(&in)))
+	m.Summary(MetricForwardBytesOut, "kind", kind).Observe(float64(atomic.LoadInt64(&out)))
+	ts.logger().Info("sshterm: forward",
+		slog.String("kind", kind),
+		slog.String("user", conn.User()),
+		slog.String("remote_addr", conn.RemoteAddr().String()),
+		slog.String("dest", addr),
+		slog.Int64("received", in),
+		slog.Int64("sent", out),
+		slog.Duration("duration", time.Since(start)))
+}
+
+// ForwardListener is a net.Listener accepting the connections passed to its
+// Handle method, so a virtual forwarding destination can be served by e.g.
+// an http.Server:
+//
+//	l := NewForwardListener()
+//	go http.Serve(l, mux)
+//	ts.LocalForward = &LocalForward{Virtual: map[string]func(net.Conn){"ui:80": l.Handle}}
+type ForwardListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewForwardListener() *ForwardListener {
+	return &ForwardListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Handle queues conn to be accepted, or closes it if the listener is
+// closed.
+func (l *ForwardListener) Handle(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *ForwardListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *ForwardListener) Close() error {
+	err := errors.New("sshterm: listener already closed")
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = nil
+	})
+	return err
+}
+
+func (l *ForwardListener) Addr() net.Addr {
+	return forwardAddr{}
+}
+
+type forwardAddr struct{}
+
+func (forwardAddr) Network() string { return "ssh-forward" }
+func (forwardAddr) String() string  { return "ssh-forward" }
+
+// RemoteForward configures tcpip-forward requests, as sent by ssh -R.
+type RemoteForward struct {
+	// Allow decides whether the connection may forward host:port. If nil,
+	// only Virtual forwards are permitted.
+	Allow func(c *Conn, host string, port int) bool
+	// Virtual, if set, registers forwards without listening on the network.
+	// They can only be reached in-process, with Conn.DialForwarded.
+	Virtual bool
+}
+
+// permits reports whether conn may forward host:port.
+func (rf *RemoteForward) permits(conn *Conn, host string, port int) bool {
+	allowed := rf.Virtual && rf.Allow == nil
+	if rf.Allow != nil {
+		allowed = rf.Allow(conn, host, port)
+	}
+	return allowed && !conn.restricted(ExtNoPortForwarding)
+}
+
+type tcpipForwardMsg struct {
+	Addr string
+	Port uint32
+}
+
+type forwardedTCPIPMsg struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+func (ts *TermServer) tcpipForward(payload []byte, conn *Conn) (bool, []byte) {
+	rf := ts.RemoteForward
+	var msg tcpipForwardMsg
+	if rf == nil || ssh.Unmarshal(payload, &msg) != nil {
+		return false, nil
+	}
+	addr := net.JoinHostPort(msg.Addr, strconv.Itoa(int(msg.Port)))
+	if !rf.permits(conn, msg.Addr, int(msg.Port)) {
+		ts.reportError(slog.LevelWarn, ts.connError("forward", conn, fmt.Errorf("denied remote forwarding of %s", addr)))
+		return false, nil
+	}
+	if rf.Virtual {
+		if msg.Port == 0 {
+			return false, nil
+		}
+		return conn.addForward(addr, nil), nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		ts.reportError(slog.LevelWarn, ts.connError("forward", conn, err))
+		return false, nil
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	addr = net.JoinHostPort(msg.Addr, strconv.Itoa(port))
+	if !conn.addForward(addr, l) {
+		l.Close()
+		return false, nil
+	}
+	go ts.serveForward(conn, msg.Addr, port, l)
+	if msg.Port == 0 {
+		return true, ssh.Marshal(struct{ Port uint32 }{uint32(port)})
+	}
+	return true, nil
+}
+
+// serveForward forwards the connections accepted by l to the client.
+func (ts *TermServer) serveForward(conn *Conn, host string, port int, l net.Listener) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			ch, err := conn.openForwarded(host, port, c.RemoteAddr())
+			if err != nil {
+				c.Close()
+				ts.reportError(slog.LevelWarn, ts.connError("forward", conn, err))
+				return
+			}
+			ts.proxy("remote", conn, addr, ch, c)
+		}()
+	}
+}
+
+func (c *Conn) addForward(addr string, l net.Listener) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.forwards[addr]; ok {
+		return false
+	}
+	if c.forwards == nil {
+		c.forwards = make(map[string]net.Listener)
+	}
+	c.forwards[addr] = l
+	return true
+}
+
+func (c *Conn) cancelForward(host string, port int) bool {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	c.mu.Lock()
+	l, ok := c.forwards[addr]
+	delete(c.forwards, addr)
+	c.mu.Unlock()
+	if ok && l != nil {
+		l.Close()
+	}
+	return ok
+}
+
+func (c *Conn) closeForwards() {
+	c.mu.Lock()
+	forwards := c.forwards
+	c.forwards = nil
+	c.mu.Unlock()
+	for _, l := range forwards {
+		if l != nil {
+			l.Close()
+		}
+	}
+}
+
+func (c *Conn) openForwarded(host string, port int, origin net.Addr) (ssh.Channel, error) {
+	msg := forwardedTCPIPMsg{Addr: host, Port: uint32(port)}
+	if tcp, ok := origin.(*net.TCPAddr); ok {
+		msg.OriginAddr = tcp.IP.String()
+		msg.OriginPort = uint32(tcp.Port)
+	}
+	ch, reqs, err := c.OpenChannel("forwarded-tcpip", ssh.Marshal(msg))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return ch, nil
+}
+
+// DialForwarded connects to a port the client has asked to be forwarded,
+// such as with ssh -R host:port:..., without going through the network.
+func (c *Conn) DialForwarded(host string, port int) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	c.mu.Lock()
+	_, ok := c.forwards[addr]
+	c.mu.Unlock()
+	if !ok {
+		return nil, errors.New("sshterm: " + addr + " is not forwarded")
+	}
+	ch, err := c.openForwarded(host, port, c.LocalAddr())
+	if err != nil {
+		return nil, err
+	}
+	return &channelConn{Channel: ch, local: c.LocalAddr(), remote: c.RemoteAddr()}, nil
+}
+
+// channelConn is an ssh.Channel used as a net.Conn. Deadlines are not
+// supported.
+type channelConn struct {
+	ssh.Channel
+	local, remote net.Addr
+}
+
+var errNoDeadline = errors.New("sshterm: deadlines are not supported on forwarded connections")
+
+func (c *channelConn) LocalAddr() net.Addr                { return c.local }
+func (c *channelConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *channelConn) SetDeadline(t time.Time) error      { return errNoDeadline }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return errNoDeadline }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return errNoDeadline }
@@ -0,0 +1,53 @@
+package sshterm
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestForwardPolicy(t *testing.T) {
+	onlyWeb := func(c *Conn, host string, port int) bool {
+		return host == "localhost" && port == 80
+	}
+	tests := []struct {
+		allow      func(c *Conn, host string, port int) bool
+		virtual    bool
+		restricted bool
+		host       string
+		port       int
+		want       bool
+	}{
+		{nil, false, false, "localhost", 80, false},
+		{nil, true, false, "localhost", 80, true},
+		{nil, true, true, "localhost", 80, false},
+		{onlyWeb, false, false, "localhost", 80, true},
+		{onlyWeb, false, false, "localhost", 22, false},
+		{onlyWeb, true, false, "localhost", 22, false},
+		{onlyWeb, false, true, "localhost", 80, false},
+	}
+	for _, test := range tests {
+		perms := &ssh.Permissions{Extensions: map[string]string{}}
+		if test.restricted {
+			perms.Extensions[ExtNoPortForwarding] = ""
+		}
+		conn := newConn(&ssh.ServerConn{Permissions: perms})
+
+		lf := &LocalForward{Allow: test.allow}
+		if got := lf.permits(conn, test.host, test.port, test.virtual); got != test.want {
+			t.Errorf("local forward to %s:%d (allow %v, virtual %v, restricted %v) = %v, want %v",
+				test.host, test.port, test.allow != nil, test.virtual, test.restricted, got, test.want)
+		}
+		rf := &RemoteForward{Allow: test.allow, Virtual: test.virtual}
+		if got := rf.permits(conn, test.host, test.port); got != test.want {
+			t.Errorf("remote forward of %s:%d (allow %v, virtual %v, restricted %v) = %v, want %v",
+				test.host, test.port, test.allow != nil, test.virtual, test.restricted, got, test.want)
+		}
+	}
+
+	// Connections authenticated without permissions are not restricted.
+	conn := newConn(&ssh.ServerConn{})
+	if !(&LocalForward{Allow: onlyWeb}).permits(conn, "localhost", 80, false) {
+		t.Error("local forward refused without permissions")
+	}
+}
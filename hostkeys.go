@@ -0,0 +1,342 @@
+package sshterm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Host key types understood by HostKeys.
+const (
+	HostKeyEd25519 = "ed25519"
+	HostKeyECDSA   = "ecdsa"
+	HostKeyRSA     = "rsa"
+)
+
+// DefaultHostKeyTypes are the host key types LoadHostKeys uses if none are
+// given.
+var DefaultHostKeyTypes = []string{HostKeyEd25519, HostKeyECDSA, HostKeyRSA}
+
+// HostKeys is a set of host keys kept in a directory, named like OpenSSH's
+// (ssh_host_ed25519_key etc.). Keys that are being rotated in are kept
+// alongside with a ".next" suffix; they are advertised to clients but not yet
+// used to sign.
+type HostKeys struct {
+	dir   string
+	types []string
+
+	mu      sync.Mutex
+	current map[string]ssh.Signer
+	next    map[string]ssh.Signer
+}
+
+// LoadHostKeys loads the host keys of the given types from dir, generating
+// any that are missing. The directory is created if needed.
+func LoadHostKeys(dir string, types ...string) (*HostKeys, error) {
+	if len(types) == 0 {
+		types = DefaultHostKeyTypes
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := tightenMode(dir, 0700); err != nil {
+		return nil, err
+	}
+	h := &HostKeys{
+		dir:     dir,
+		types:   types,
+		current: map[string]ssh.Signer{},
+		next:    map[string]ssh.Signer{},
+	}
+	for _, typ := range types {
+		signer, err := loadOrGenerateHostKey(h.path(typ), typ)
+		if err != nil {
+			return nil, err
+		}
+		h.current[typ] = signer
+		signer, err = loadHostKey(h.path(typ) + ".next")
+		if err == nil {
+			h.next[typ] = signer
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *HostKeys) path(typ string) string {
+	return filepath.Join(h.dir, "ssh_host_"+typ+"_key")
+}
+
+func generateHostKey(typ string) (crypto.Signer, error) {
+	switch typ {
+	case HostKeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case HostKeyECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case HostKeyRSA:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}
+	return nil, fmt.Errorf("unknown host key type %q", typ)
+}
+
+// tightenMode removes any permissions on path beyond perm, so that keys
+// written by other tools, or before a umask change, are not left readable by
+// others.
+func tightenMode(path string, perm fs.FileMode) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&^perm == 0 {
+		return nil
+	}
+	return os.Chmod(path, fi.Mode().Perm()&perm)
+}
+
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := tightenMode(path, 0600); err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return signer, nil
+}
+
+func loadOrGenerateHostKey(path, typ string) (ssh.Signer, error) {
+	signer, err := loadHostKey(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return signer, err
+	}
+	return writeHostKey(path, typ)
+}
+
+// writeHostKey generates a key of the given type and writes it to path,
+// readable only by the owner, with its public half next to it.
+func writeHostKey(path, typ string) (ssh.Signer, error) {
+	key, err := generateHostKey(typ)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+	return signer, err
+}
+
+// AddTo registers the current host keys on conf.
+func (h *HostKeys) AddTo(conf *ssh.ServerConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, typ := range h.types {
+		conf.AddHostKey(h.current[typ])
+	}
+}
+
+// Fingerprints returns the SHA256 fingerprints of the current host keys, and
+// of any keys being rotated in, in the form "ssh-ed25519 SHA256:...".
+func (h *HostKeys) Fingerprints() []string {
+	var fps []string
+	for _, key := range h.PublicKeys() {
+		fps = append(fps, key.Type()+" "+ssh.FingerprintSHA256(key))
+	}
+	return fps
+}
+
+// PublicKeys returns the current host keys followed by any being rotated in.
+func (h *HostKeys) PublicKeys() []ssh.PublicKey {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var keys []ssh.PublicKey
+	for _, typ := range h.types {
+		keys = append(keys, h.current[typ].PublicKey())
+	}
+	for _, typ := range h.types {
+		if signer, ok := h.next[typ]; ok {
+			keys = append(keys, signer.PublicKey())
+		}
+	}
+	return keys
+}
+
+// Rotate generates new keys of the given types, or of all types if none are
+// given, to replace the current ones. They are advertised to clients straight
+// away so clients that support it (OpenSSH's UpdateHostKeys) learn them
+// before Promote makes them current.
+func (h *HostKeys) Rotate(types ...string) error {
+	if len(types) == 0 {
+		types = h.types
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, typ := range types {
+		if _, ok := h.current[typ]; !ok {
+			return fmt.Errorf("host key type %q is not loaded", typ)
+		}
+		if _, ok := h.next[typ]; ok {
+			continue
+		}
+		signer, err := writeHostKey(h.path(typ)+".next", typ)
+		if err != nil {
+			return err
+		}
+		h.next[typ] = signer
+	}
+	return nil
+}
+
+// Promote makes the keys being rotated in current, keeping the replaced keys
+// with a ".old" suffix. Configs only sign with the new keys once AddTo is
+// called for them again, so this is usually done before the server starts
+// listening.
+func (h *HostKeys) Promote() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, typ := range h.types {
+		signer, ok := h.next[typ]
+		if !ok {
+			continue
+		}
+		if err := promoteHostKey(h.path(typ), signer); err != nil {
+			return err
+		}
+		h.current[typ] = signer
+		delete(h.next, typ)
+	}
+	return nil
+}
+
+// promoteHostKey moves the key at path to path.old and path.next to path.
+// The ".pub" files are only a convenience for administrators, so missing
+// ones are tolerated and the new one is written from signer.
+func promoteHostKey(path string, signer ssh.Signer) error {
+	if _, err := os.Stat(path + ".next"); err != nil {
+		return err
+	}
+	if err := os.Rename(path, path+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".next", path); err != nil {
+		os.Rename(path+".old", path)
+		return err
+	}
+	if err := os.Rename(path+".pub", path+".old.pub"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(path + ".next.pub"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+}
+
+// signer returns the current or next signer for the public key blob.
+func (h *HostKeys) signer(blob []byte) ssh.Signer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, signers := range []map[string]ssh.Signer{h.current, h.next} {
+		for _, signer := range signers {
+			if bytes.Equal(signer.PublicKey().Marshal(), blob) {
+				return signer
+			}
+		}
+	}
+	return nil
+}
+
+type hostKeyProof struct {
+	Request   string
+	SessionID []byte
+	HostKey   []byte
+}
+
+// Prove answers a hostkeys-prove-00@openssh.com request, with which a client
+// checks that the server holds the advertised keys before it updates its
+// known_hosts. It returns false if any of the requested keys is unknown.
+func (h *HostKeys) Prove(conn ssh.ConnMetadata, payload []byte) (bool, []byte) {
+	var reply []byte
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return false, nil
+		}
+		n := binary.BigEndian.Uint32(payload)
+		if uint64(len(payload)-4) < uint64(n) {
+			return false, nil
+		}
+		blob := payload[4 : 4+n]
+		payload = payload[4+n:]
+
+		signer := h.signer(blob)
+		if signer == nil {
+			return false, nil
+		}
+		data := ssh.Marshal(hostKeyProof{"hostkeys-prove-00@openssh.com", conn.SessionID(), blob})
+		var sig *ssh.Signature
+		var err error
+		// RSA keys are not proven with SHA-1 signatures. OpenSSH accepts
+		// rsa-sha2-512 unless rsa-sha2-256 was negotiated for the key
+		// exchange, which x/crypto does not expose.
+		if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			sig, err = as.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		} else {
+			sig, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			return false, nil
+		}
+		sigBlob := ssh.Marshal(sig)
+		reply = binary.BigEndian.AppendUint32(reply, uint32(len(sigBlob)))
+		reply = append(reply, sigBlob...)
+	}
+	return true, reply
+}
+
+// Advertise sends the host keys to the client in a hostkeys-00@openssh.com
+// request, so clients that support it can update their known_hosts.
+func (h *HostKeys) Advertise(conn ssh.Conn) error {
+	var payload []byte
+	for _, key := range h.PublicKeys() {
+		blob := key.Marshal()
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(blob)))
+		payload = append(payload, blob...)
+	}
+	_, _, err := conn.SendRequest("hostkeys-00@openssh.com", false, payload)
+	return err
+}
@@ -0,0 +1,193 @@
+package sshterm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func fileMode(t *testing.T, path string) os.FileMode {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Mode().Perm()
+}
+
+func TestLoadHostKeys(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	h, err := LoadHostKeys(dir, HostKeyEd25519, HostKeyECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fileMode(t, dir); mode != 0700 {
+		t.Errorf("directory mode %o, want 700", mode)
+	}
+	key := filepath.Join(dir, "ssh_host_ed25519_key")
+	if mode := fileMode(t, key); mode != 0600 {
+		t.Errorf("key mode %o, want 600", mode)
+	}
+
+	// Loose modes left by other tools are tightened when loading.
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(key, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadHostKeys(dir, HostKeyEd25519, HostKeyECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fileMode(t, dir); mode != 0700 {
+		t.Errorf("directory mode %o after reload, want 700", mode)
+	}
+	if mode := fileMode(t, key); mode != 0600 {
+		t.Errorf("key mode %o after reload, want 600", mode)
+	}
+	want, got := h.Fingerprints(), reloaded.Fingerprints()
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("reloaded fingerprints %q, want %q", got, want)
+	}
+}
+
+func TestHostKeysRotate(t *testing.T) {
+	dir := t.TempDir()
+	h, err := LoadHostKeys(dir, HostKeyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := h.PublicKeys()[0]
+	if err := h.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	keys := h.PublicKeys()
+	if len(keys) != 2 || !bytes.Equal(keys[0].Marshal(), old.Marshal()) {
+		t.Fatalf("after Rotate got %d keys, want the current key then the next", len(keys))
+	}
+	next := keys[1]
+
+	// The key being rotated in survives a restart.
+	reloaded, err := LoadHostKeys(dir, HostKeyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := reloaded.PublicKeys(); len(keys) != 2 || !bytes.Equal(keys[1].Marshal(), next.Marshal()) {
+		t.Error("next key not loaded after restart")
+	}
+
+	if err := h.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	keys = h.PublicKeys()
+	if len(keys) != 1 || !bytes.Equal(keys[0].Marshal(), next.Marshal()) {
+		t.Fatal("next key is not current after Promote")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ssh_host_ed25519_key.old")); err != nil {
+		t.Errorf("replaced key not kept: %v", err)
+	}
+	reloaded, err = LoadHostKeys(dir, HostKeyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := reloaded.PublicKeys(); len(keys) != 1 || !bytes.Equal(keys[0].Marshal(), next.Marshal()) {
+		t.Error("promoted key not current after restart")
+	}
+}
+
+func TestHostKeysPromoteWithoutPub(t *testing.T) {
+	dir := t.TempDir()
+	h, err := LoadHostKeys(dir, HostKeyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	next := h.PublicKeys()[1]
+	path := filepath.Join(dir, "ssh_host_ed25519_key")
+	for _, pub := range []string{path + ".pub", path + ".next.pub"} {
+		if err := os.Remove(pub); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := h.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := h.PublicKeys(); len(keys) != 1 || !bytes.Equal(keys[0].Marshal(), next.Marshal()) {
+		t.Fatal("next key is not current after Promote")
+	}
+	data, err := os.ReadFile(path + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, _, _, _, err := ssh.ParseAuthorizedKey(data); err != nil || !bytes.Equal(pub.Marshal(), next.Marshal()) {
+		t.Errorf("public key file does not hold the promoted key: %v", err)
+	}
+	reloaded, err := LoadHostKeys(dir, HostKeyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := reloaded.PublicKeys(); len(keys) != 1 || !bytes.Equal(keys[0].Marshal(), next.Marshal()) {
+		t.Error("promoted key not current after restart")
+	}
+}
+
+func TestHostKeysProve(t *testing.T) {
+	h, err := LoadHostKeys(t.TempDir(), HostKeyEd25519, HostKeyRSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Rotate(HostKeyEd25519); err != nil {
+		t.Fatal(err)
+	}
+	conn := testConnMetadata{user: "alice"}
+	sessionID := []byte("session")
+
+	var payload []byte
+	keys := h.PublicKeys()
+	for _, key := range keys {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(key.Marshal())))
+		payload = append(payload, key.Marshal()...)
+	}
+	ok, reply := h.Prove(sessionMetadata{conn, sessionID}, payload)
+	if !ok {
+		t.Fatal("prove request refused")
+	}
+	for _, key := range keys {
+		if len(reply) < 4 {
+			t.Fatalf("no signature for %s", key.Type())
+		}
+		n := binary.BigEndian.Uint32(reply)
+		var sig ssh.Signature
+		if err := ssh.Unmarshal(reply[4:4+n], &sig); err != nil {
+			t.Fatal(err)
+		}
+		reply = reply[4+n:]
+		data := ssh.Marshal(hostKeyProof{"hostkeys-prove-00@openssh.com", sessionID, key.Marshal()})
+		if err := key.Verify(data, &sig); err != nil {
+			t.Errorf("%s proof: %v", key.Type(), err)
+		}
+		if key.Type() == ssh.KeyAlgoRSA && sig.Format != ssh.KeyAlgoRSASHA512 {
+			t.Errorf("RSA key proven with %s", sig.Format)
+		}
+	}
+
+	unknown := testPublicKey(t).Marshal()
+	payload = binary.BigEndian.AppendUint32(nil, uint32(len(unknown)))
+	if ok, _ := h.Prove(conn, append(payload, unknown...)); ok {
+		t.Error("proved a key the server does not hold")
+	}
+}
+
+type sessionMetadata struct {
+	ssh.ConnMetadata
+	id []byte
+}
+
+func (m sessionMetadata) SessionID() []byte { return m.id }
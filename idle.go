@@ -0,0 +1,85 @@
+package sshterm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// IdleExitStatus is the exit status sent to clients disconnected by
+// TermServer.IdleTimeout.
+const IdleExitStatus = 124
+
+// keepAlive sends keepalive@openssh.com requests to the client every
+// KeepAliveInterval and closes the connection once KeepAliveCountMax of them
+// in a row have gone unanswered.
+func (ts *TermServer) keepAlive(conn *Conn) {
+	max := ts.KeepAliveCountMax
+	if max <= 0 {
+		max = 3
+	}
+	ticker := time.NewTicker(ts.KeepAliveInterval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		reply := make(chan error, 1)
+		go func() {
+			// Any reply, even a failure, shows the peer is alive.
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err != nil {
+				// the connection is gone
+				return
+			}
+			missed = 0
+			<-ticker.C
+		case <-ticker.C:
+			missed++
+			if missed >= max {
+				ts.reportError(slog.LevelInfo, ts.connError("keepalive", conn, fmt.Errorf("no reply to %d keepalives", missed)))
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// watchIdle ends the session once no input has been received on t for
+// IdleTimeout, warning the user IdleWarning beforehand.
+func (ts *TermServer) watchIdle(s *Session, t *tb.Termbox) {
+	warned := false
+	for {
+		remaining := ts.IdleTimeout - time.Since(t.LastInput())
+		if remaining <= 0 {
+			ts.reportError(slog.LevelInfo, ts.sessionError("idle", s, errors.New("idle timeout")))
+			t.Close()
+			io.WriteString(s.ch, "Disconnected after being idle for "+ts.IdleTimeout.String()+".\r\n")
+			s.Exit(IdleExitStatus)
+			return
+		}
+		wait := remaining
+		if ts.IdleWarning > 0 {
+			if remaining <= ts.IdleWarning {
+				if !warned {
+					t.Overlay(fmt.Sprintf(" Idle: disconnecting in %s unless a key is pressed ", remaining.Round(time.Second)))
+					warned = true
+				}
+			} else {
+				warned = false
+				wait = remaining - ts.IdleWarning
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-s.Context().Done():
+			return
+		}
+	}
+}
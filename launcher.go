@@ -0,0 +1,163 @@
+package sshterm
+
+import (
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// App is an application offered by a Launcher.
+type App struct {
+	Name        string
+	Description string
+	Handler     Handler
+	// Allow, if set, decides whether the app is offered to the session.
+	Allow func(s *Session) error
+}
+
+// Launcher is a Handler showing a menu of applications. The chosen app takes
+// over the session's Termbox; when it calls Session.Exit or Session.Close the
+// menu is shown again. Apps run from a launcher should leave the Termbox open,
+// if they close it the session ends with them.
+type Launcher struct {
+	Title string
+	Apps  []App
+}
+
+// Apps returns the router's routes as launcher applications.
+func (r *Router) Apps() []App {
+	apps := make([]App, len(r.Routes))
+	for i, route := range r.Routes {
+		apps[i] = App{
+			Name:        route.Name,
+			Description: route.Description,
+			Handler:     route.Handler,
+			Allow:       route.Allow,
+		}
+	}
+	return apps
+}
+
+// Handle is the launcher's Handler.
+func (l *Launcher) Handle(t *tb.Termbox, s *Session) Term {
+	var apps []App
+	for _, app := range l.Apps {
+		if app.Allow == nil || app.Allow(s) == nil {
+			apps = append(apps, app)
+		}
+	}
+	g := &gateTerm{t: t}
+	s.goSafe(t, func() {
+		l.run(t, s, g, apps)
+	})
+	return g
+}
+
+// menuTop is the row of the first app in the menu.
+const menuTop = 3
+
+func (l *Launcher) run(t *tb.Termbox, s *Session, g *gateTerm, apps []App) {
+	mode := t.SetInputMode(tb.InputCurrent)
+	t.SetInputMode(mode | tb.InputMouse)
+	sel := 0
+	for {
+		l.draw(t, apps, sel)
+		ev := t.PollEventWithContext(s.Context())
+		launch := false
+		switch ev.Type {
+		case tb.EventKey:
+			switch {
+			case ev.Key == tb.KeyArrowUp || ev.Ch == 'k':
+				sel--
+			case ev.Key == tb.KeyArrowDown || ev.Ch == 'j':
+				sel++
+			case ev.Key == tb.KeyHome:
+				sel = 0
+			case ev.Key == tb.KeyEnd:
+				sel = len(apps) - 1
+			case ev.Key == tb.KeyEnter:
+				launch = true
+			case ev.Key == tb.KeyEsc || ev.Key == tb.KeyCtrlC || ev.Ch == 'q':
+				t.Close()
+				s.Exit(0)
+				return
+			}
+		case tb.EventMouse:
+			switch ev.Key {
+			case tb.MouseWheelUp:
+				sel--
+			case tb.MouseWheelDown:
+				sel++
+			case tb.MouseLeft:
+				if i := ev.MouseY - menuTop; i >= 0 && i < len(apps) {
+					sel, launch = i, true
+				}
+			}
+		case tb.EventError, tb.EventCancel:
+			return
+		}
+		if sel < 0 {
+			sel = 0
+		}
+		if sel >= len(apps) {
+			sel = len(apps) - 1
+		}
+		if launch && sel >= 0 {
+			t.SetInputMode(mode)
+			if !l.launch(t, s, g, apps[sel]) {
+				return
+			}
+			t.SetInputMode(mode | tb.InputMouse)
+			t.HideCursor()
+		}
+	}
+}
+
+// launch runs app until it exits, reporting whether the menu should be shown
+// again.
+func (l *Launcher) launch(t *tb.Termbox, s *Session, g *gateTerm, app App) bool {
+	done := make(chan int, 1)
+	s.setExitHook(func(code int) { done <- code })
+	t.Clear(tb.ColorDefault, tb.ColorDefault)
+	g.handoff(app.Handler(t, s))
+
+	var code int
+	select {
+	case code = <-done:
+	case <-s.Context().Done():
+		return false
+	}
+	g.handoff(nil)
+	if t.Closed() {
+		s.Exit(code)
+		return false
+	}
+	return true
+}
+
+func (l *Launcher) draw(t *tb.Termbox, apps []App, sel int) {
+	const fg, bg = tb.ColorDefault, tb.ColorDefault
+	t.Clear(fg, bg)
+	w, h := t.Size()
+	title := l.Title
+	if title == "" {
+		title = "Applications"
+	}
+	drawText(t, 1, 1, title, fg|tb.AttrBold, bg)
+	if len(apps) == 0 {
+		drawText(t, 3, menuTop, "No applications available", fg, bg)
+	}
+	for i, app := range apps {
+		afg, abg := fg, bg
+		if i == sel {
+			afg |= tb.AttrReverse
+			for x := 1; x < w-1; x++ {
+				t.SetCell(x, menuTop+i, ' ', afg, abg)
+			}
+		}
+		x := drawText(t, 3, menuTop+i, app.Name, afg|tb.AttrBold, abg)
+		if app.Description != "" {
+			drawText(t, x+3, menuTop+i, app.Description, afg, abg)
+		}
+	}
+	drawText(t, 1, h-1, "Enter: open  Up/Down: select  q: quit", fg|tb.AttrReverse, bg)
+	t.Flush()
+}
@@ -0,0 +1,108 @@
+package sshterm
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// connLimiter enforces TermServer's connection limits and rate.
+type connLimiter struct {
+	ts *TermServer
+
+	mu     sync.Mutex
+	total  int
+	perIP  map[string]int
+	tokens float64
+	last   time.Time
+}
+
+func newConnLimiter(ts *TermServer) *connLimiter {
+	return &connLimiter{
+		ts:     ts,
+		perIP:  map[string]int{},
+		tokens: float64(ts.connectionBurst()),
+		last:   time.Now(),
+	}
+}
+
+func (ts *TermServer) connectionBurst() int {
+	if ts.ConnectionBurst > 0 {
+		return ts.ConnectionBurst
+	}
+	return 1
+}
+
+func (ts *TermServer) limiter() *connLimiter {
+	ts.limiterOnce.Do(func() {
+		ts.connLimiter = newConnLimiter(ts)
+	})
+	return ts.connLimiter
+}
+
+// admit applies the connection limits to a newly accepted connection,
+// closing it if they are exceeded. release must be called once an admitted
+// connection has ended.
+func (ts *TermServer) admit(conn net.Conn) (release func(), ok bool) {
+	limiter := ts.limiter()
+	if !limiter.allow() {
+		conn.Close()
+		ts.reportError(slog.LevelWarn, &OpError{Op: "limit", RemoteAddr: conn.RemoteAddr(), Err: errors.New("connection rate exceeded")})
+		return nil, false
+	}
+	ip := hostOf(conn.RemoteAddr())
+	if reason, ok := limiter.acquire(ip); !ok {
+		conn.Close()
+		ts.reportError(slog.LevelWarn, &OpError{Op: "limit", RemoteAddr: conn.RemoteAddr(), Err: errors.New(reason)})
+		return nil, false
+	}
+	return func() { limiter.release(ip) }, true
+}
+
+// allow takes a token from the bucket refilled at ConnectionRate per second.
+func (l *connLimiter) allow() bool {
+	if l.ts.ConnectionRate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.ts.ConnectionRate
+	l.last = now
+	if burst := float64(l.ts.connectionBurst()); l.tokens > burst {
+		l.tokens = burst
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// acquire reserves a connection slot for ip, reporting the limit that was
+// reached if there is none.
+func (l *connLimiter) acquire(ip string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max := l.ts.MaxConnections; max > 0 && l.total >= max {
+		return "too many connections", false
+	}
+	if max := l.ts.MaxConnectionsPerIP; max > 0 && l.perIP[ip] >= max {
+		return "too many connections from " + ip, false
+	}
+	l.total++
+	l.perIP[ip]++
+	return "", true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
@@ -0,0 +1,78 @@
+package sshterm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnLimiterRate(t *testing.T) {
+	tests := []struct {
+		rate   float64
+		burst  int
+		tokens float64
+		idle   time.Duration
+		calls  int
+		want   int
+	}{
+		{0, 0, 0, 0, 10, 10},
+		{1, 0, 1, 0, 3, 1},
+		{1, 3, 3, 0, 5, 3},
+		{2, 5, 0, time.Second, 5, 2},
+		{10, 2, 0, time.Second, 5, 2},
+		{1, 1, 0, 100 * time.Millisecond, 1, 0},
+	}
+	for _, test := range tests {
+		ts := &TermServer{ConnectionRate: test.rate, ConnectionBurst: test.burst}
+		l := newConnLimiter(ts)
+		l.tokens = test.tokens
+		l.last = time.Now().Add(-test.idle)
+		got := 0
+		for i := 0; i < test.calls; i++ {
+			if l.allow() {
+				got++
+			}
+		}
+		if got != test.want {
+			t.Errorf("rate %v burst %d tokens %v idle %s: allowed %d of %d, want %d",
+				test.rate, test.burst, test.tokens, test.idle, got, test.calls, test.want)
+		}
+	}
+}
+
+func TestConnLimiterAcquire(t *testing.T) {
+	tests := []struct {
+		max, perIP int
+		ips        []string
+		want       []bool
+	}{
+		{0, 0, []string{"a", "a", "a"}, []bool{true, true, true}},
+		{2, 0, []string{"a", "b", "c"}, []bool{true, true, false}},
+		{0, 2, []string{"a", "a", "a", "b"}, []bool{true, true, false, true}},
+		{3, 1, []string{"a", "a", "b", "c", "d"}, []bool{true, false, true, true, false}},
+	}
+	for _, test := range tests {
+		ts := &TermServer{MaxConnections: test.max, MaxConnectionsPerIP: test.perIP}
+		l := newConnLimiter(ts)
+		var held []string
+		for i, ip := range test.ips {
+			_, ok := l.acquire(ip)
+			if ok != test.want[i] {
+				t.Errorf("max %d per IP %d: connection %d from %s admitted = %v, want %v",
+					test.max, test.perIP, i, ip, ok, test.want[i])
+			}
+			if ok {
+				held = append(held, ip)
+			}
+		}
+		for _, ip := range held {
+			l.release(ip)
+		}
+		if l.total != 0 || len(l.perIP) != 0 {
+			t.Errorf("max %d per IP %d: %d connections and %d addresses left after release",
+				test.max, test.perIP, l.total, len(l.perIP))
+		}
+		if _, ok := l.acquire(test.ips[0]); !ok {
+			t.Errorf("max %d per IP %d: connection refused after release", test.max, test.perIP)
+		}
+	}
+}
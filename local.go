@@ -0,0 +1,112 @@
+//go:build unix
+
+package sshterm
+
+import (
+	"os"
+	"os/signal"
+	"os/user"
+	"sync"
+	"syscall"
+
+	"golang.org/x/term"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// RunLocal runs the server's Handler, with its middleware, on the terminal
+// of the current process instead of over SSH, until the session ends. This
+// is meant for development:
+//
+//	if *local {
+//		log.Fatal(ts.RunLocal())
+//	}
+//	ts.Listen(l)
+//
+// The terminal is put in raw mode for the duration and TERM is taken from
+// the environment. The session's user is the current user.
+func (ts *TermServer) RunLocal() error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+	// tty.Fd would make reads blocking, and Close could no longer stop the
+	// Termbox reading from it.
+	rc, err := tty.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var w, h int
+	var state *term.State
+	rc.Control(func(fd uintptr) {
+		w, h, err = term.GetSize(int(fd))
+		if err == nil {
+			state, err = term.MakeRaw(int(fd))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer rc.Control(func(fd uintptr) {
+		term.Restore(int(fd), state)
+	})
+
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	ch := &localChannel{File: tty, done: make(chan struct{})}
+	s := newTransportSession(ts, name, localAddr{}, ch)
+	s.verified = true
+	ts.metrics().Gauge(MetricSessionsActive).Add(1)
+	defer ts.endSession(s)
+
+	var t *tb.Termbox
+	defer func() {
+		if r := recover(); r != nil {
+			ts.sessionPanic(s, t, r)
+		}
+	}()
+	t, err = ts.initTerm(s, tty, tty, os.Getenv("TERM"), w, h)
+	if err != nil {
+		return err
+	}
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	current := ts.handler()(t, s)
+	for {
+		select {
+		case <-winch:
+			rc.Control(func(fd uintptr) {
+				w, h, err = term.GetSize(int(fd))
+			})
+			ts.metrics().Counter(MetricResizes).Add(1)
+			if err == nil && current != nil {
+				current.Resize(w, h)
+			}
+		case <-ch.done:
+			return nil
+		}
+	}
+}
+
+// localChannel is the terminal of a local session. Closing it ends the
+// session but leaves the terminal open until RunLocal returns.
+type localChannel struct {
+	*os.File
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *localChannel) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+type localAddr struct{}
+
+func (localAddr) Network() string { return "local" }
+func (localAddr) String() string  { return "local" }
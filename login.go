@@ -0,0 +1,173 @@
+package sshterm
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// LoginScreen asks for a user name and password inside the terminal before
+// handing the session to the handler, for users who cannot manage SSH
+// credentials. It is meant to be used with ssh.ServerConfig.NoClientAuth set;
+// the entered user name becomes the session's Identity, and that of later
+// sessions on the same connection.
+//
+// The screen only guards the Handler. With NoClientAuth, also set
+// TermServer.RequireLogin, or clients can use subsystems such as SFTP and
+// port forwarding without ever logging in.
+type LoginScreen struct {
+	// Title is shown above the form.
+	Title string
+	// Authenticate checks the entered credentials.
+	Authenticate func(user, password string) error
+	// MaxAttempts is the number of failed attempts after which the session
+	// is ended. Defaults to 3.
+	MaxAttempts int
+	// MaxFailures is the number of consecutive failures after which a user
+	// name, and separately a source address, is locked out for Lockout.
+	// Failures are forgotten Lockout after the last one. Defaults to 5
+	// failures and 15 minutes.
+	MaxFailures int
+	Lockout     time.Duration
+
+	once    sync.Once
+	lockout *lockout
+}
+
+func (l *LoginScreen) init() {
+	l.once.Do(func() {
+		max, duration := l.MaxFailures, l.Lockout
+		if max <= 0 {
+			max = 5
+		}
+		if duration <= 0 {
+			duration = 15 * time.Minute
+		}
+		l.lockout = newLockout(max, duration)
+	})
+}
+
+// Middleware returns the middleware showing the login screen.
+func (l *LoginScreen) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(t *tb.Termbox, s *Session) Term {
+			return gate(t, s, func() bool { return l.run(t, s) }, next)
+		}
+	}
+}
+
+func (l *LoginScreen) check(s *Session, user, password string) (bool, string) {
+	userKey, ipKey := "user:"+user, "ip:"+hostOf(s.RemoteAddr())
+	if l.lockout.locked(userKey, ipKey) {
+		return false, errLockedOut.Error()
+	}
+	if err := l.Authenticate(user, password); err != nil {
+		l.lockout.fail(userKey, ipKey)
+		return false, "Login incorrect"
+	}
+	l.lockout.reset(userKey)
+	return true, ""
+}
+
+func (l *LoginScreen) run(t *tb.Termbox, s *Session) bool {
+	l.init()
+	maxAttempts := l.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	end := func(msg string) bool {
+		t.Close()
+		io.WriteString(s.ch, msg+"\r\n")
+		s.Exit(1)
+		return false
+	}
+
+	var fields [2][]rune
+	field, attempts := 0, 0
+	msg := ""
+	for {
+		l.draw(t, fields, field, msg)
+		ev := t.PollEventWithContext(s.Context())
+		switch ev.Type {
+		case tb.EventKey:
+		case tb.EventResize:
+			continue
+		case tb.EventError, tb.EventCancel:
+			return false
+		default:
+			continue
+		}
+		switch ev.Key {
+		case tb.KeyCtrlC, tb.KeyCtrlD, tb.KeyEsc:
+			return end("login cancelled")
+		case tb.KeyTab, tb.KeyArrowDown, tb.KeyArrowUp:
+			field = 1 - field
+		case tb.KeyBackspace, tb.KeyBackspace2:
+			if n := len(fields[field]); n > 0 {
+				fields[field] = fields[field][:n-1]
+			}
+		case tb.KeyEnter:
+			if field == 0 {
+				field = 1
+				continue
+			}
+			user := strings.TrimSpace(string(fields[0]))
+			ok, failure := l.check(s, user, string(fields[1]))
+			if ok {
+				s.setLogin(user)
+				t.HideCursor()
+				return true
+			}
+			attempts++
+			if attempts >= maxAttempts {
+				return end("too many failed attempts")
+			}
+			fields = [2][]rune{}
+			field, msg = 0, failure
+		case tb.KeySpace:
+			fields[field] = append(fields[field], ' ')
+		default:
+			if ev.Ch != 0 {
+				fields[field] = append(fields[field], ev.Ch)
+			}
+		}
+	}
+}
+
+func (l *LoginScreen) draw(t *tb.Termbox, fields [2][]rune, field int, msg string) {
+	const fg, bg = tb.ColorDefault, tb.ColorDefault
+	t.Clear(fg, bg)
+	w, h := t.Size()
+	x, y := w/2-20, h/2-3
+	if x < 0 {
+		x = 0
+	}
+	if y < 0 {
+		y = 0
+	}
+	title := l.Title
+	if title == "" {
+		title = "Login"
+	}
+	drawText(t, x, y, title, fg|tb.AttrBold, bg)
+	labels := [2]string{"Username: ", "Password: "}
+	cursorX := 0
+	for i, label := range labels {
+		value := string(fields[i])
+		if i == 1 {
+			value = strings.Repeat("*", len(fields[i]))
+		}
+		end := drawText(t, drawText(t, x, y+2+i, label, fg, bg), y+2+i, value, fg|tb.AttrUnderline, bg)
+		if i == field {
+			cursorX = end
+		}
+	}
+	if msg != "" {
+		drawText(t, x, y+5, msg, tb.ColorRed, bg)
+	}
+	t.SetCursor(cursorX, y+2+field)
+	t.Flush()
+}
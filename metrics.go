@@ -0,0 +1,275 @@
+package sshterm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Metric names reported by TermServer.
+const (
+	MetricConnectionsActive = "sshterm_connections_active"
+	MetricSessionsActive    = "sshterm_sessions_active"
+	MetricHandshakeFailures = "sshterm_handshake_failures_total"
+	MetricSessions          = "sshterm_sessions_total"
+	MetricSessionBytesIn    = "sshterm_session_received_bytes"
+	MetricSessionBytesOut   = "sshterm_session_sent_bytes"
+	MetricFlushDuration     = "sshterm_flush_duration_seconds"
+	MetricFlushBytes        = "sshterm_flush_bytes"
+	MetricResizes           = "sshterm_resizes_total"
+	MetricForwards          = "sshterm_forwards_total"
+	MetricForwardsActive    = "sshterm_forwards_active"
+	MetricForwardBytesIn    = "sshterm_forward_received_bytes"
+	MetricForwardBytesOut   = "sshterm_forward_sent_bytes"
+)
+
+// Counter is a value that only goes up.
+type Counter interface {
+	Add(v float64)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge interface {
+	Add(v float64)
+}
+
+// Observer records samples of a distribution.
+type Observer interface {
+	Observe(v float64)
+}
+
+// Metrics is the registry TermServer reports its instrumentation to. Labels
+// are given as alternating name, value pairs.
+type Metrics interface {
+	Counter(name string, labels ...string) Counter
+	Gauge(name string, labels ...string) Gauge
+	Summary(name string, labels ...string) Observer
+}
+
+type nopMetric struct{}
+
+func (nopMetric) Add(float64)     {}
+func (nopMetric) Observe(float64) {}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, ...string) Counter  { return nopMetric{} }
+func (nopMetrics) Gauge(string, ...string) Gauge      { return nopMetric{} }
+func (nopMetrics) Summary(string, ...string) Observer { return nopMetric{} }
+
+func (ts *TermServer) metrics() Metrics {
+	if ts.Metrics != nil {
+		return ts.Metrics
+	}
+	return nopMetrics{}
+}
+
+// handshakeFailureReason classifies a handshake error for the
+// MetricHandshakeFailures label.
+func handshakeFailureReason(err error) string {
+	var authErr *ssh.ServerAuthError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &authErr):
+		return "auth"
+	case errors.Is(err, io.EOF):
+		return "eof"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "protocol"
+}
+
+// termFamilies are the terminal types the Termbox has a description of,
+// in the order it matches them against TERM.
+var termFamilies = []string{"xterm", "rxvt", "linux", "Eterm", "screen", "cygwin", "st"}
+
+// termLabel maps TERM to the terminal family the Termbox matched it to, or
+// "other". TERM is chosen by the client, so it cannot be used as a label
+// directly without allowing an unbounded number of series.
+func termLabel(term string) string {
+	for _, family := range termFamilies {
+		if strings.Contains(term, family) {
+			return family
+		}
+	}
+	return "other"
+}
+
+// countingReader and countingWriter tally the bytes passing through a
+// session's terminal or a forwarded connection.
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// Registry is an in-memory Metrics implementation. It serves its contents in
+// the Prometheus text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metricFamily
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: map[string]*metricFamily{},
+	}
+}
+
+type metricFamily struct {
+	kind   string
+	series map[string]*metricValue
+}
+
+type metricValue struct {
+	mu    sync.Mutex
+	value float64
+	count uint64
+}
+
+func (v *metricValue) Add(d float64) {
+	v.mu.Lock()
+	v.value += d
+	v.mu.Unlock()
+}
+
+func (v *metricValue) Observe(d float64) {
+	v.mu.Lock()
+	v.value += d
+	v.count++
+	v.mu.Unlock()
+}
+
+func (r *Registry) get(kind, name string, labels []string) *metricValue {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.metrics[name]
+	if !ok {
+		f = &metricFamily{kind: kind, series: map[string]*metricValue{}}
+		r.metrics[name] = f
+	}
+	key := formatLabels(labels)
+	v, ok := f.series[key]
+	if !ok {
+		v = &metricValue{}
+		f.series[key] = v
+	}
+	return v
+}
+
+func (r *Registry) Counter(name string, labels ...string) Counter {
+	return r.get("counter", name, labels)
+}
+
+func (r *Registry) Gauge(name string, labels ...string) Gauge {
+	return r.get("gauge", name, labels)
+}
+
+func (r *Registry) Summary(name string, labels ...string) Observer {
+	return r.get("summary", name, labels)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// WriteTo writes the registry's metrics to w in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		r.mu.Lock()
+		f := r.metrics[name]
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		values := make([]*metricValue, len(keys))
+		sort.Strings(keys)
+		for i, key := range keys {
+			values[i] = f.series[key]
+		}
+		r.mu.Unlock()
+
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, f.kind)
+		for i, key := range keys {
+			v := values[i]
+			v.mu.Lock()
+			value, count := v.value, v.count
+			v.mu.Unlock()
+			if f.kind == "summary" {
+				fmt.Fprintf(&b, "%s_sum%s %g\n", name, key, value)
+				fmt.Fprintf(&b, "%s_count%s %d\n", name, key, count)
+				continue
+			}
+			fmt.Fprintf(&b, "%s%s %g\n", name, key, value)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the registry's metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// observeFlush returns a flush hook reporting to the flush metrics.
+func (ts *TermServer) observeFlush() func(d time.Duration, n int) {
+	m := ts.metrics()
+	duration := m.Summary(MetricFlushDuration)
+	bytes := m.Summary(MetricFlushBytes)
+	return func(d time.Duration, n int) {
+		duration.Observe(d.Seconds())
+		bytes.Observe(float64(n))
+	}
+}
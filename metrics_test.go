@@ -0,0 +1,47 @@
+package sshterm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+	r.Gauge(MetricSessionsActive).Add(2)
+	r.Counter(MetricSessions, "term", `xterm"1`).Add(1)
+	r.Summary(MetricFlushBytes).Observe(10)
+	r.Summary(MetricFlushBytes).Observe(5)
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	want := `# TYPE sshterm_flush_bytes summary
+sshterm_flush_bytes_sum 15
+sshterm_flush_bytes_count 2
+# TYPE sshterm_sessions_active gauge
+sshterm_sessions_active 2
+# TYPE sshterm_sessions_total counter
+sshterm_sessions_total{term="xterm\"1"} 1
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestTermLabel(t *testing.T) {
+	tests := map[string]string{
+		"xterm-256color": "xterm",
+		"rxvt-unicode":   "rxvt",
+		"screen.xterm":   "xterm",
+		"st-256color":    "st",
+		"stxterm-42":     "xterm",
+		"almoststupid":   "st",
+		"vt100":          "other",
+	}
+	for term, want := range tests {
+		if got := termLabel(term); got != want {
+			t.Errorf("termLabel(%q) = %q, want %q", term, got, want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package sshterm
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TOTP generates and verifies RFC 6238 time-based one-time passwords using
+// HMAC-SHA1, as used by common authenticator apps. The zero value uses 6
+// digits, a 30 second period and accepts codes one period either side of the
+// current one.
+type TOTP struct {
+	Digits int
+	Period time.Duration
+	// Skew is the number of periods either side of the current one that are
+	// also accepted. Negative values accept only the current period.
+	Skew int
+	// Clock returns the current time. If nil, time.Now is used.
+	Clock func() time.Time
+}
+
+func (t *TOTP) digits() int {
+	if t.Digits <= 0 {
+		return 6
+	}
+	return t.Digits
+}
+
+func (t *TOTP) period() time.Duration {
+	if t.Period <= 0 {
+		return 30 * time.Second
+	}
+	return t.Period
+}
+
+func (t *TOTP) now() time.Time {
+	if t.Clock != nil {
+		return t.Clock()
+	}
+	return time.Now()
+}
+
+func (t *TOTP) counter(at time.Time) uint64 {
+	return uint64(at.Unix() / int64(t.period()/time.Second))
+}
+
+func (t *TOTP) code(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < t.digits(); i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", t.digits(), value%mod)
+}
+
+// Code returns the code for secret at the given time.
+func (t *TOTP) Code(secret []byte, at time.Time) string {
+	return t.code(secret, t.counter(at))
+}
+
+// match returns the counter of the period code is valid for.
+func (t *TOTP) match(secret []byte, code string) (uint64, bool) {
+	now := t.counter(t.now())
+	skew := t.Skew
+	if skew == 0 {
+		skew = 1
+	} else if skew < 0 {
+		skew = 0
+	}
+	for i := -skew; i <= skew; i++ {
+		c := now + uint64(i)
+		if subtle.ConstantTimeCompare([]byte(t.code(secret, c)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// Verify reports whether code is currently valid for secret.
+func (t *TOTP) Verify(secret []byte, code string) bool {
+	_, ok := t.match(secret, code)
+	return ok
+}
+
+// DecodeSecret decodes a base32 TOTP secret as shown by authenticator apps,
+// ignoring case, spaces and missing padding.
+func DecodeSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	s = strings.TrimRight(s, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+}
+
+// SecretStore looks up users' TOTP secrets.
+type SecretStore interface {
+	// TOTPSecret returns the secret of user, or an error if they have none.
+	TOTPSecret(user string) ([]byte, error)
+}
+
+// SecretMap is a SecretStore held in memory.
+type SecretMap map[string][]byte
+
+func (m SecretMap) TOTPSecret(user string) ([]byte, error) {
+	secret, ok := m[user]
+	if !ok {
+		return nil, fmt.Errorf("no TOTP secret for %q", user)
+	}
+	return secret, nil
+}
+
+// lockout counts failures per key and locks a key out for a while once it
+// reaches the limit. Counts are forgotten duration after the last failure.
+type lockout struct {
+	max      int
+	duration time.Duration
+
+	mu      sync.Mutex
+	entries map[string]lockoutEntry
+}
+
+type lockoutEntry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// maxLockoutEntries bounds the keys a lockout tracks, as clients choose the
+// user names in them.
+const maxLockoutEntries = 10000
+
+func newLockout(max int, duration time.Duration) *lockout {
+	return &lockout{
+		max:      max,
+		duration: duration,
+		entries:  map[string]lockoutEntry{},
+	}
+}
+
+func (l *lockout) locked(keys ...string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if e, ok := l.entries[key]; ok && now.Before(e.until) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *lockout) fail(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		e, ok := l.entries[key]
+		if ok && now.Sub(e.last) >= l.duration {
+			e = lockoutEntry{}
+		}
+		if !ok && len(l.entries) >= maxLockoutEntries {
+			l.sweep(now)
+		}
+		e.failures++
+		e.last = now
+		if e.failures >= l.max {
+			e.until = now.Add(l.duration)
+		}
+		l.entries[key] = e
+	}
+}
+
+// sweep forgets expired entries, and if that is not enough to make room
+// the one whose last failure is oldest.
+func (l *lockout) sweep(now time.Time) {
+	var oldest string
+	for key, e := range l.entries {
+		if now.Sub(e.last) >= l.duration {
+			delete(l.entries, key)
+		} else if oldest == "" || e.last.Before(l.entries[oldest].last) {
+			oldest = key
+		}
+	}
+	if len(l.entries) >= maxLockoutEntries {
+		delete(l.entries, oldest)
+	}
+}
+
+func (l *lockout) reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.entries, key)
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+var errLockedOut = errors.New("too many failed attempts, try again later")
+
+// ExtMFA is set to "totp" once a user has passed the MFA challenge.
+const ExtMFA = "sshterm-mfa"
+
+// MFA adds a keyboard-interactive TOTP challenge after a first factor. Wrap
+// the first factor's callback with PublicKeyCallback or PasswordCallback; when
+// it succeeds the client is told of partial success and asked for a code.
+type MFA struct {
+	Secrets SecretStore
+	TOTP    TOTP
+	// MaxFailures is the number of consecutive failed codes after which a
+	// user, and separately a source address, is locked out for Lockout.
+	// Failures are forgotten Lockout after the last one. Defaults to 5
+	// failures and 15 minutes.
+	MaxFailures int
+	Lockout     time.Duration
+
+	once    sync.Once
+	lockout *lockout
+	mu      sync.Mutex
+	used    map[string]uint64
+}
+
+func (m *MFA) init() {
+	m.once.Do(func() {
+		max, duration := m.MaxFailures, m.Lockout
+		if max <= 0 {
+			max = 5
+		}
+		if duration <= 0 {
+			duration = 15 * time.Minute
+		}
+		m.lockout = newLockout(max, duration)
+		m.used = map[string]uint64{}
+	})
+}
+
+// PublicKeyCallback wraps next so that keys it accepts must be followed by a
+// valid code.
+func (m *MFA) PublicKeyCallback(next func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)) func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		perms, err := next(c, key)
+		if err != nil {
+			return nil, err
+		}
+		// x/crypto requires nil permissions with a partial success, so it
+		// cannot enforce a certificate's source-address itself.
+		if err := checkSourceAddress(c.RemoteAddr(), perms); err != nil {
+			return nil, err
+		}
+		return nil, m.challenge(perms)
+	}
+}
+
+// PasswordCallback wraps next so that passwords it accepts must be followed
+// by a valid code.
+func (m *MFA) PasswordCallback(next func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error)) func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		perms, err := next(c, pass)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSourceAddress(c.RemoteAddr(), perms); err != nil {
+			return nil, err
+		}
+		return nil, m.challenge(perms)
+	}
+}
+
+// checkSourceAddress enforces the source-address critical option of perms,
+// a list of addresses and CIDR ranges, against addr.
+func checkSourceAddress(addr net.Addr, perms *ssh.Permissions) error {
+	if perms == nil {
+		return nil
+	}
+	list, ok := perms.CriticalOptions["source-address"]
+	if !ok {
+		return nil
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("source-address restriction, but %v is not a TCP address", addr)
+	}
+	for _, entry := range strings.Split(list, ",") {
+		if ip := net.ParseIP(entry); ip != nil {
+			if ip.Equal(tcpAddr.IP) {
+				return nil
+			}
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid source-address %q: %w", entry, err)
+		}
+		if ipnet.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v is not allowed by source-address", addr)
+}
+
+func (m *MFA) challenge(first *ssh.Permissions) error {
+	return &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				if err := m.verify(c, client); err != nil {
+					return nil, err
+				}
+				// Only the last step's permissions reach the connection,
+				// so carry the first factor's forward.
+				perms := &ssh.Permissions{Extensions: map[string]string{}}
+				if first != nil {
+					perms.CriticalOptions = first.CriticalOptions
+					for k, v := range first.Extensions {
+						perms.Extensions[k] = v
+					}
+				}
+				perms.Extensions[ExtMFA] = "totp"
+				return perms, nil
+			},
+		},
+	}
+}
+
+func (m *MFA) verify(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) error {
+	m.init()
+	user, _ := SplitUser(c.User())
+	userKey, ipKey := "user:"+user, "ip:"+hostOf(c.RemoteAddr())
+	if m.lockout.locked(userKey, ipKey) {
+		return errLockedOut
+	}
+	secret, err := m.Secrets.TOTPSecret(user)
+	if err != nil {
+		return err
+	}
+	answers, err := client("", "", []string{"Verification code: "}, []bool{false})
+	if err != nil {
+		return err
+	}
+	if len(answers) != 1 {
+		return errors.New("expected a single answer")
+	}
+	counter, ok := m.TOTP.match(secret, strings.TrimSpace(answers[0]))
+	if ok {
+		// Each code may only be used once.
+		m.mu.Lock()
+		if last, seen := m.used[user]; seen && counter <= last {
+			ok = false
+		} else {
+			m.used[user] = counter
+		}
+		m.mu.Unlock()
+	}
+	if !ok {
+		m.lockout.fail(userKey, ipKey)
+		return fmt.Errorf("invalid verification code for %q", c.User())
+	}
+	m.lockout.reset(userKey)
+	return nil
+}
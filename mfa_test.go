@@ -0,0 +1,168 @@
+package sshterm
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Test vectors from RFC 6238 appendix B, SHA1 only.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	totp := &TOTP{Digits: 8}
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, test := range tests {
+		if got := totp.Code(secret, time.Unix(test.unix, 0)); got != test.code {
+			t.Errorf("Code at %d = %s, want %s", test.unix, got, test.code)
+		}
+	}
+}
+
+func TestTOTPVerifySkew(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	totp := &TOTP{Clock: func() time.Time { return now }}
+	if !totp.Verify(secret, totp.Code(secret, now.Add(-30*time.Second))) {
+		t.Error("code from the previous period was rejected")
+	}
+	if totp.Verify(secret, totp.Code(secret, now.Add(-90*time.Second))) {
+		t.Error("code from three periods ago was accepted")
+	}
+}
+
+// dialMFA runs a handshake authenticating with signer and a TOTP code
+// against an MFA wrapping CertAuth, and returns the client's error.
+func dialMFA(t *testing.T, ca ssh.PublicKey, signer ssh.Signer) error {
+	secret := []byte("12345678901234567890")
+	mfa := &MFA{Secrets: SecretMap{"alice": secret}}
+	certAuth := &CertAuth{CAKeys: []ssh.PublicKey{ca}}
+	conf := &ssh.ServerConfig{PublicKeyCallback: mfa.PublicKeyCallback(certAuth.PublicKeyCallback)}
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if sshConn, chans, reqs, err := ssh.NewServerConn(c, conf); err == nil {
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "")
+				}
+			}()
+			sshConn.Wait()
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				return []string{mfa.TOTP.Code(secret, time.Now())}, nil
+			}),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		client.Close()
+	}
+	return err
+}
+
+func TestMFAKeepsSourceAddress(t *testing.T) {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, userKey, _ := ed25519.GenerateKey(rand.Reader)
+	user, err := ssh.NewSignerFromKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certSigner := func(sourceAddress string) ssh.Signer {
+		cert := &ssh.Certificate{
+			Key:             user.PublicKey(),
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{"alice"},
+			ValidBefore:     ssh.CertTimeInfinity,
+			Permissions: ssh.Permissions{
+				CriticalOptions: map[string]string{"source-address": sourceAddress},
+			},
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewCertSigner(cert, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+
+	if err := dialMFA(t, ca.PublicKey(), certSigner("127.0.0.1/32")); err != nil {
+		t.Errorf("login from an allowed address failed: %v", err)
+	}
+	if err := dialMFA(t, ca.PublicKey(), certSigner("10.9.9.9/32")); err == nil {
+		t.Error("login from outside the certificate's source-address succeeded")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	l := newLockout(2, 50*time.Millisecond)
+	l.fail("user:alice")
+	if l.locked("user:alice") {
+		t.Fatal("locked after one failure")
+	}
+	time.Sleep(60 * time.Millisecond)
+	l.fail("user:alice")
+	if l.locked("user:alice") {
+		t.Fatal("a failure older than the lockout still counted")
+	}
+	l.fail("user:alice")
+	if !l.locked("user:alice", "ip:127.0.0.1") {
+		t.Fatal("not locked after two failures")
+	}
+	if l.locked("ip:127.0.0.1") {
+		t.Error("unrelated key locked")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if l.locked("user:alice") {
+		t.Error("still locked after the lockout")
+	}
+
+	for i := 0; i < maxLockoutEntries+100; i++ {
+		l.fail(fmt.Sprintf("user:%d", i))
+	}
+	if n := len(l.entries); n > maxLockoutEntries {
+		t.Errorf("tracking %d keys, want at most %d", n, maxLockoutEntries)
+	}
+}
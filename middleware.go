@@ -0,0 +1,125 @@
+package sshterm
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// Handler starts the application for a new session and returns the Term that
+// receives its window changes. It may return nil if the session has already
+// been ended.
+type Handler func(t *tb.Termbox, s *Session) Term
+
+// ServerConnHandler adapts a handler written for the earlier signature of
+// TermServer.Handler, which was given the session's *ssh.ServerConn. Sessions
+// that are not served over SSH pass a nil connection.
+func ServerConnHandler(h func(t *tb.Termbox, conn *ssh.ServerConn) Term) Handler {
+	return func(t *tb.Termbox, s *Session) Term {
+		var conn *ssh.ServerConn
+		if s.Conn() != nil {
+			conn = s.Conn().ServerConn
+		}
+		return h(t, conn)
+	}
+}
+
+// Middleware wraps a Handler with additional behaviour.
+type Middleware func(next Handler) Handler
+
+// Use appends middleware to the chain wrapped around Handler. The first
+// middleware registered is the outermost one.
+func (ts *TermServer) Use(mw ...Middleware) {
+	ts.middleware = append(ts.middleware, mw...)
+}
+
+func (ts *TermServer) handler() Handler {
+	h := ts.Handler
+	for i := len(ts.middleware) - 1; i >= 0; i-- {
+		h = ts.middleware[i](h)
+	}
+	return h
+}
+
+// Recover recovers from panics in the handler, restores the client's terminal
+// and prints an error before ending the session. Only panics raised while the
+// handler itself runs are caught, not those in goroutines it starts.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(t *tb.Termbox, s *Session) (term Term) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Close()
+					fmt.Fprintf(s.ch, "internal error: %v\r\n", r)
+					s.Exit(1)
+					term = nil
+				}
+			}()
+			return next(t, s)
+		}
+	}
+}
+
+// AccessLog logs the start and end of every session to l, or to the
+// server's Logger if l is nil.
+func AccessLog(l *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(t *tb.Termbox, s *Session) Term {
+			l := l
+			if l == nil {
+				l = s.server.logger()
+			}
+			start := time.Now()
+			attrs := []any{
+				slog.String("user", s.User()),
+				slog.String("remote_addr", s.RemoteAddr().String()),
+			}
+			l.Info("sshterm: session start", append(attrs, slog.String("term", s.Term()))...)
+			go func() {
+				<-s.Context().Done()
+				l.Info("sshterm: session end", append(attrs, slog.Duration("duration", time.Since(start)))...)
+			}()
+			return next(t, s)
+		}
+	}
+}
+
+// MaxSessionsPerUser limits the number of concurrent sessions each user may
+// have open, across all of their connections. Users are told apart by the
+// name part of Identity, so "alice+admin" and "alice+chat" share a limit.
+// Sessions over the limit are told so and ended.
+func MaxSessionsPerUser(n int) Middleware {
+	var mu sync.Mutex
+	active := map[string]int{}
+	return func(next Handler) Handler {
+		return func(t *tb.Termbox, s *Session) Term {
+			user, _ := SplitUser(s.Identity())
+			mu.Lock()
+			if active[user] >= n {
+				mu.Unlock()
+				t.Close()
+				io.WriteString(s.ch, "too many sessions\r\n")
+				s.Exit(1)
+				return nil
+			}
+			active[user]++
+			mu.Unlock()
+			go func() {
+				<-s.Context().Done()
+				mu.Lock()
+				active[user]--
+				if active[user] == 0 {
+					delete(active, user)
+				}
+				mu.Unlock()
+			}()
+			return next(t, s)
+		}
+	}
+}
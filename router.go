@@ -0,0 +1,101 @@
+package sshterm
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// Route is an application served by a Router.
+type Route struct {
+	// Name identifies the route for the "user+app" convention and in the
+	// fallback menu.
+	Name        string
+	Description string
+	// Users is a path.Match pattern matched against the SSH user name, such
+	// as "dashboard" or "admin-*". If empty, the route is only reached by
+	// Name.
+	Users   string
+	Handler Handler
+	// Allow, if set, decides whether the session may use the route. The
+	// error is shown to the user when it denies them.
+	Allow func(s *Session) error
+}
+
+// Router picks the handler of each session by the user name it connected
+// with, so several applications can be served on one port. Set a
+// TermServer's Handler to its Handle method.
+type Router struct {
+	Routes []Route
+	// Fallback handles sessions that match no route. If nil, a Launcher
+	// offers the routes the session is allowed.
+	Fallback Handler
+}
+
+// SplitUser splits a "user+app" user name into its parts. app is empty if the
+// name does not use the convention. The authentication providers in this
+// package look users up by name, so "alice+admin" authenticates as alice;
+// other authentication callbacks should do the same.
+func SplitUser(user string) (name, app string) {
+	if i := strings.LastIndexByte(user, '+'); i > 0 {
+		return user[:i], user[i+1:]
+	}
+	return user, ""
+}
+
+// Add appends a route.
+func (r *Router) Add(route Route) {
+	r.Routes = append(r.Routes, route)
+}
+
+// Match returns the route for the given user name. Routes named by the
+// "user+app" convention take precedence over Users patterns.
+func (r *Router) Match(user string) (*Route, bool) {
+	if _, app := SplitUser(user); app != "" {
+		for i := range r.Routes {
+			if r.Routes[i].Name == app {
+				return &r.Routes[i], true
+			}
+		}
+	}
+	for i := range r.Routes {
+		if r.Routes[i].Users == "" {
+			continue
+		}
+		if ok, _ := path.Match(r.Routes[i].Users, user); ok {
+			return &r.Routes[i], true
+		}
+	}
+	return nil, false
+}
+
+// Handle is a Handler dispatching to the matching route. When a route is
+// picked with the "user+app" convention and no identity has been
+// established, the user part becomes the session's Identity.
+func (r *Router) Handle(t *tb.Termbox, s *Session) Term {
+	route, ok := r.Match(s.User())
+	if !ok {
+		if r.Fallback != nil {
+			return r.Fallback(t, s)
+		}
+		if name, _ := SplitUser(s.User()); s.identity == "" {
+			s.identity = name
+		}
+		launcher := &Launcher{Apps: r.Apps()}
+		return launcher.Handle(t, s)
+	}
+	if name, app := SplitUser(s.User()); app == route.Name && s.identity == "" {
+		s.identity = name
+	}
+	if route.Allow != nil {
+		if err := route.Allow(s); err != nil {
+			t.Close()
+			io.WriteString(s.ch, route.Name+": "+err.Error()+"\r\n")
+			s.Exit(1)
+			return nil
+		}
+	}
+	return route.Handler(t, s)
+}
@@ -0,0 +1,34 @@
+package sshterm
+
+import "testing"
+
+func TestRouterMatch(t *testing.T) {
+	r := &Router{}
+	r.Add(Route{Name: "dashboard", Users: "dashboard"})
+	r.Add(Route{Name: "admin", Users: "admin-*"})
+	r.Add(Route{Name: "hidden"})
+
+	tests := []struct {
+		user  string
+		route string
+	}{
+		{"dashboard", "dashboard"},
+		{"admin-bob", "admin"},
+		{"alice+hidden", "hidden"},
+		{"alice+admin", "admin"},
+		{"admin-bob+dashboard", "dashboard"},
+		{"alice", ""},
+		{"hidden", ""},
+		{"alice+unknown", ""},
+	}
+	for _, test := range tests {
+		route, ok := r.Match(test.user)
+		got := ""
+		if ok {
+			got = route.Name
+		}
+		if got != test.route {
+			t.Errorf("Match(%q) = %q, want %q", test.user, got, test.route)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package sshterm
+
+import (
+	"sync"
+
+	"github.com/mattn/go-runewidth"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// drawText draws s starting at x, y and returns the column after it.
+func drawText(t *tb.Termbox, x, y int, s string, fg, bg tb.Attribute) int {
+	for _, r := range s {
+		t.SetCell(x, y, r, fg, bg)
+		x += runewidth.RuneWidth(r)
+	}
+	return x
+}
+
+// gateTerm is the Term of a session while a screen, such as the login form,
+// runs before the real handler. Once the handler has taken over, window
+// changes are passed on to its Term.
+type gateTerm struct {
+	t *tb.Termbox
+
+	mu   sync.Mutex
+	next Term
+}
+
+func (g *gateTerm) Resize(w, h int) {
+	g.mu.Lock()
+	next := g.next
+	g.mu.Unlock()
+	if next != nil {
+		next.Resize(w, h)
+		return
+	}
+	g.t.Resize(w, h)
+}
+
+func (g *gateTerm) handoff(next Term) {
+	g.mu.Lock()
+	g.next = next
+	g.mu.Unlock()
+}
+
+// gate runs screen on the session and, if it returns true, hands the session
+// to next. screen owns the Termbox until it returns; it should end the
+// session itself before returning false.
+func gate(t *tb.Termbox, s *Session, screen func() bool, next Handler) Term {
+	g := &gateTerm{t: t}
+	s.goSafe(t, func() {
+		if !screen() {
+			return
+		}
+		t.Clear(tb.ColorDefault, tb.ColorDefault)
+		g.handoff(next(t, s))
+	})
+	return g
+}
@@ -0,0 +1,247 @@
+package sshterm
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// WriteFile is a file opened for writing by a WriteFS.
+type WriteFile interface {
+	fs.File
+	io.WriterAt
+}
+
+// WriteFS is an fs.FS that can also be modified. Names are slash-separated
+// and valid according to fs.ValidPath.
+type WriteFS interface {
+	fs.FS
+	OpenFile(name string, flag int, perm fs.FileMode) (WriteFile, error)
+	Mkdir(name string, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldname, newname string) error
+}
+
+// DirFS is a WriteFS for a directory on disk. Names cannot escape the
+// directory, not even through symbolic links.
+type DirFS struct {
+	root *os.Root
+}
+
+// OpenDirFS opens dir as a DirFS. It must be closed after use.
+func OpenDirFS(dir string) (*DirFS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &DirFS{root: root}, nil
+}
+
+func (d *DirFS) Open(name string) (fs.File, error) {
+	return d.root.Open(name)
+}
+
+func (d *DirFS) Stat(name string) (fs.FileInfo, error) {
+	return d.root.Stat(name)
+}
+
+func (d *DirFS) OpenFile(name string, flag int, perm fs.FileMode) (WriteFile, error) {
+	return d.root.OpenFile(name, flag, perm)
+}
+
+func (d *DirFS) Mkdir(name string, perm fs.FileMode) error {
+	return d.root.Mkdir(name, perm)
+}
+
+func (d *DirFS) Remove(name string) error {
+	return d.root.Remove(name)
+}
+
+func (d *DirFS) Rename(oldname, newname string) error {
+	return d.root.Rename(oldname, newname)
+}
+
+func (d *DirFS) Close() error {
+	return d.root.Close()
+}
+
+// UserDirs roots every user in their own directory below base, named after
+// Session.Identity and created on first use. It is meant to be passed to
+// SFTP. Sessions whose Identity is not Authenticated, such as those admitted
+// by NoClientAuth that have not logged in, are refused, since they chose
+// their user name themselves.
+func UserDirs(base string) func(s *Session) (fs.FS, error) {
+	return func(s *Session) (fs.FS, error) {
+		if !s.Authenticated() {
+			return nil, errors.New("sshterm: no authenticated identity")
+		}
+		id := s.Identity()
+		if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+			return nil, errors.New("invalid user name for a directory: " + id)
+		}
+		dir := filepath.Join(base, id)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		return OpenDirFS(dir)
+	}
+}
+
+// SFTP is a subsystem serving the file system root returns for the session
+// over SFTP. The file system is read-only unless it is a WriteFS, and is
+// closed at the end of the session if it is an io.Closer. Files must
+// implement io.ReaderAt to be downloaded, as those of os, embed and
+// testing/fstest do.
+//
+// Register it as the "sftp" subsystem:
+//
+//	ts.Subsystems = map[string]SubsystemHandler{"sftp": SFTP(UserDirs("/srv/reports"))}
+func SFTP(root func(s *Session) (fs.FS, error)) SubsystemHandler {
+	return func(ch ssh.Channel, s *Session) error {
+		fsys, err := root(s)
+		if err != nil {
+			return err
+		}
+		if c, ok := fsys.(io.Closer); ok {
+			defer c.Close()
+		}
+		h := &sftpHandler{fsys: fsys}
+		server := sftp.NewRequestServer(ch, sftp.Handlers{
+			FileGet:  h,
+			FilePut:  h,
+			FileCmd:  h,
+			FileList: h,
+		})
+		if err := server.Serve(); err != io.EOF {
+			return err
+		}
+		return nil
+	}
+}
+
+// sftpHandler implements the sftp request handlers on an fs.FS.
+type sftpHandler struct {
+	fsys fs.FS
+}
+
+// sftpName converts an SFTP path to an fs.FS name.
+func sftpName(p string) string {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (h *sftpHandler) writable() (WriteFS, error) {
+	wfs, ok := h.fsys.(WriteFS)
+	if !ok {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	return wfs, nil
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.fsys.Open(sftpName(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		f.Close()
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	return ra, nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	wfs, err := h.writable()
+	if err != nil {
+		return nil, err
+	}
+	// O_APPEND is left out, as it cannot be combined with WriteAt. Clients
+	// appending send the offsets to write at anyway.
+	pflags := r.Pflags()
+	flag := os.O_WRONLY
+	if pflags.Read {
+		flag = os.O_RDWR
+	}
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	return wfs.OpenFile(sftpName(r.Filepath), flag, 0o644)
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	wfs, err := h.writable()
+	if err != nil {
+		return err
+	}
+	name := sftpName(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		// Attributes are not stored, but clients preserving them should
+		// not fail.
+		return nil
+	case "Rename":
+		return wfs.Rename(name, sftpName(r.Target))
+	case "Rmdir", "Remove":
+		return wfs.Remove(name)
+	case "Mkdir":
+		return wfs.Mkdir(name, 0o755)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name := sftpName(r.Filepath)
+	switch r.Method {
+	case "List":
+		entries, err := fs.ReadDir(h.fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]fs.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		info, err := fs.Stat(h.fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type listerAt []fs.FileInfo
+
+func (l listerAt) ListAt(ls []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,92 @@
+package sshterm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pkg/sftp"
+)
+
+func TestSFTPName(t *testing.T) {
+	tests := []struct {
+		path, name string
+	}{
+		{"", "."},
+		{"/", "."},
+		{".", "."},
+		{"a/b", "a/b"},
+		{"/a/b/", "a/b"},
+		{"a/./b", "a/b"},
+		{"..", "."},
+		{"../../etc/passwd", "etc/passwd"},
+		{"/a/../../etc", "etc"},
+		{"a/../..", "."},
+	}
+	for _, test := range tests {
+		if got := sftpName(test.path); got != test.name {
+			t.Errorf("sftpName(%q) = %q, want %q", test.path, got, test.name)
+		}
+	}
+}
+
+func TestSFTPConfined(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "alice")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(base, "secret"), "secret")
+	writeFile(t, filepath.Join(dir, "report"), "report")
+	if err := os.Symlink(filepath.Join(base, "secret"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := OpenDirFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.Close()
+	h := &sftpHandler{fsys: fsys}
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"/report", true},
+		{"../alice/report", false},
+		{"../secret", false},
+		{"/../../secret", false},
+		{"link", false},
+	}
+	for _, test := range tests {
+		_, err := h.Fileread(sftp.NewRequest("Get", test.path))
+		if (err == nil) != test.ok {
+			t.Errorf("read %q: got error %v, want ok %v", test.path, err, test.ok)
+		}
+	}
+	if _, err := h.Filewrite(sftp.NewRequest("Put", "../escaped")); err == nil {
+		t.Error("wrote outside the directory")
+	}
+	if _, err := os.Stat(filepath.Join(base, "escaped")); err == nil {
+		t.Error("file created outside the directory")
+	}
+}
+
+func TestSFTPReadOnly(t *testing.T) {
+	h := &sftpHandler{fsys: fstest.MapFS{"report": {Data: []byte("report")}}}
+	if _, err := h.Fileread(sftp.NewRequest("Get", "/report")); err != nil {
+		t.Errorf("read failed: %v", err)
+	}
+	if _, err := h.Filewrite(sftp.NewRequest("Put", "/report")); !errors.Is(err, sftp.ErrSSHFxPermissionDenied) {
+		t.Errorf("write: got error %v, want permission denied", err)
+	}
+	for _, method := range []string{"Setstat", "Rename", "Rmdir", "Remove", "Mkdir"} {
+		r := sftp.NewRequest(method, "/report")
+		r.Target = "/moved"
+		if err := h.Filecmd(r); !errors.Is(err, sftp.ErrSSHFxPermissionDenied) {
+			t.Errorf("%s: got error %v, want permission denied", method, err)
+		}
+	}
+}
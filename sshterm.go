@@ -2,106 +2,133 @@ package sshterm
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	tb "github.com/andyleap/SSHTerm/SSHTermbox"
 )
 
-/*
-func NewTermServer()
-	config := &ssh.ServerConfig{
-		//Define a function to run when a client attempts a password login
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			// Should use constant-time compare (or better, salt+hash) in a production setting.
-			var user User
-			NoUsers := false
-			err := db.View(func(tx *bolt.Tx) error {
-				users := tx.Bucket([]byte("Users"))
-				if users == nil {
-					NoUsers = true
-					return nil
-				}
-				rawUser := users.Get([]byte(c.User()))
-				if rawUser == nil {
-					return fmt.Errorf("password rejected for %q", c.User())
-				}
-				json.Unmarshal(rawUser, &user)
-				return nil
-			})
-			if err != nil {
-				return nil, err
-			}
-			if NoUsers {
-				return nil, nil
-			}
-			if c.User() == user.Name && bcrypt.CompareHashAndPassword(user.Password, pass) == nil {
-				log.Printf("User %s logged in", c.User())
-				return nil, nil
-			}
-			return nil, fmt.Errorf("password rejected for %q", c.User())
-		},
-	}
+type Term interface {
+	Resize(w, h int)
+}
 
-	// You can generate a keypair with 'ssh-keygen -t rsa'
-	privateBytes, err := ioutil.ReadFile("id_rsa")
-	if err != nil {
-		pk, _ := rsa.GenerateKey(rand.Reader, 2048)
-		pkBytes := x509.MarshalPKCS1PrivateKey(pk)
-		b := &pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: pkBytes,
-		}
-		privateBytes = pem.EncodeToMemory(b)
+// SubsystemHandler serves a subsystem such as "sftp" on a session's channel.
+// The session's Env and Identity are available to it. The session ends when
+// it returns, with the exit status of an ExitStatus error, 1 for any other
+// error and 0 otherwise.
+type SubsystemHandler func(ch ssh.Channel, s *Session) error
 
-		ioutil.WriteFile("id_rsa", privateBytes, 0777)
-	}
+// ExitStatus is an error a SubsystemHandler can return to end its session
+// with a specific exit status.
+type ExitStatus int
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		log.Fatal("Failed to parse private key")
-	}
+func (e ExitStatus) Error() string {
+	return "exit status " + strconv.Itoa(int(e))
+}
 
-	config.AddHostKey(private)
+type TermServer struct {
+	Config *ssh.ServerConfig
+	// Handler starts the application for each session. Over SSH it is
+	// started by the shell request that follows a pty-req, so the variables
+	// of env requests sent before the shell are in Session.Env. It used to
+	// be given the *ssh.ServerConn rather than the *Session;
+	// ServerConnHandler adapts handlers written that way.
+	Handler Handler
 
-	// Once a ServerConfig has been configured, connections can be accepted.
-	listener, err := net.Listen("tcp", "0.0.0.0:2200")
-	if err != nil {
-		log.Fatalf("Failed to listen on 2200 (%s)", err)
-	}
+	// OnConnect is called once a connection has completed its handshake,
+	// before any of its sessions are handled.
+	OnConnect func(c *Conn)
+	// OnDisconnect is called once a connection has closed and all of its
+	// sessions have ended.
+	OnDisconnect func(c *Conn)
+	// OnPanic is called after a panic in a session's handler or Term has been
+	// recovered and the session ended. If nil, the panic is logged.
+	OnPanic func(s *Session, v interface{}, stack []byte)
 
-	// Accept all connections
-	log.Print("Listening on 2200...")
-	for {
-		tcpConn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Failed to accept incoming connection (%s)", err)
-			continue
-		}
-		// Before use, a handshake must be performed on the incoming net.Conn.
-		sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, config)
-		if err != nil {
-			log.Printf("Failed to handshake (%s)", err)
-			continue
-		}
+	// Logger receives the server's diagnostics. If nil, slog.Default() is
+	// used.
+	Logger *slog.Logger
+	// ErrorHandler, if set, is called with an *OpError for every failure the
+	// server handles internally, after it has been logged.
+	ErrorHandler func(err error)
+	// Metrics receives the server's instrumentation, see the Metric*
+	// constants for what is reported. NewRegistry provides an implementation
+	// that can be served to Prometheus.
+	Metrics Metrics
+	// HostKeys, if set, are advertised to every client after the handshake
+	// with the hostkeys-00@openssh.com extension, and proven to clients that
+	// ask. They still have to be added to Config with HostKeys.AddTo.
+	HostKeys *HostKeys
 
-		log.Printf("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
-		// Discard all global out-of-band Requests
-		go ssh.DiscardRequests(reqs)
-		// Accept all channels
-		go handleChannels(chans)
-	}
-}*/
+	// MaxConnections and MaxConnectionsPerIP limit the number of concurrent
+	// connections, in total and from a single address. Connections over the
+	// limit are closed before the handshake. Zero means unlimited.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	// MaxSessionsPerConn limits the number of concurrent sessions on one
+	// connection. Zero means unlimited.
+	MaxSessionsPerConn int
+	// HandshakeTimeout bounds the time a client may take to complete the
+	// handshake, including authentication. Zero means no timeout.
+	HandshakeTimeout time.Duration
+	// ConnectionRate limits new connections to this many per second, with
+	// bursts of up to ConnectionBurst (default 1). Zero means unlimited.
+	ConnectionRate  float64
+	ConnectionBurst int
 
-type Term interface {
-	Resize(w, h int)
-}
+	// KeepAliveInterval, if set, is how often keepalive@openssh.com requests
+	// are sent to detect dead clients. The connection is closed after
+	// KeepAliveCountMax (default 3) of them go unanswered.
+	KeepAliveInterval time.Duration
+	KeepAliveCountMax int
+	// IdleTimeout, if set, ends sessions that have received no input for
+	// that long. If IdleWarning is also set, a warning is overlaid on the
+	// screen that long before the session ends.
+	IdleTimeout time.Duration
+	IdleWarning time.Duration
 
-type TermServer struct {
-	Config  *ssh.ServerConfig
-	Handler func(tb *tb.Termbox, sshConn *ssh.ServerConn) Term
+	// RequireLogin confines connections to the Handler until one of their
+	// sessions has logged in with LoginScreen: subsystems, port forwarding
+	// and agent forwarding are refused until then. Set it whenever
+	// LoginScreen is the only authentication.
+	RequireLogin bool
+
+	// Subsystems maps subsystem names, such as "sftp", to their handlers.
+	// Requests for other subsystems are rejected.
+	Subsystems map[string]SubsystemHandler
+	// LocalForward, if set, enables direct-tcpip channels (ssh -L) to the
+	// destinations it permits.
+	LocalForward *LocalForward
+	// RemoteForward, if set, enables tcpip-forward requests (ssh -R) for
+	// the ports it permits.
+	RemoteForward *RemoteForward
+
+	// AcceptEnv lists the environment variables clients may set, as
+	// path.Match patterns such as "LANG" or "LC_*". If nil, all are
+	// accepted. Variables sent once the shell or a subsystem has started
+	// are refused.
+	AcceptEnv []string
+	// MaxEnvVars and MaxEnvSize limit the number of environment variables a
+	// session may set and their total size in bytes. They default to 64 and
+	// 32 KiB.
+	MaxEnvVars int
+	MaxEnvSize int
+
+	middleware  []Middleware
+	banner      func(conn ssh.ConnMetadata) string
+	configOnce  sync.Once
+	limiterOnce sync.Once
+	connLimiter *connLimiter
 }
 
 func New(conf *ssh.ServerConfig) *TermServer {
@@ -110,25 +137,172 @@ func New(conf *ssh.ServerConfig) *TermServer {
 	}
 }
 
+// Listen accepts connections on l until it is closed. Accept errors are
+// retried after a delay growing from 5ms to 1s, as net/http does.
 func (ts *TermServer) Listen(l net.Listener) {
+	ts.configOnce.Do(ts.prepareConfig)
+	var delay time.Duration
 	for {
 		tcpConn, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, time.Second)
+			}
+			ts.reportError(slog.LevelError, &OpError{Op: "accept", Err: err}, slog.Duration("retry_in", delay))
+			time.Sleep(delay)
 			continue
 		}
-		sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, ts.Config)
-		if err != nil {
+		delay = 0
+		release, ok := ts.admit(tcpConn)
+		if !ok {
 			continue
 		}
-		go ssh.DiscardRequests(reqs)
-		go ts.handleChannels(chans, sshConn)
+		go func() {
+			defer release()
+			ts.serveConn(tcpConn)
+		}()
+	}
+}
+
+// prepareConfig installs the banner, and marks connections admitted by
+// NoClientAuth so their user name is not taken as authenticated.
+func (ts *TermServer) prepareConfig() {
+	if ts.Config.BannerCallback == nil {
+		ts.Config.BannerCallback = ts.banner
+	}
+	if ts.Config.NoClientAuth {
+		next := ts.Config.NoClientAuthCallback
+		ts.Config.NoClientAuthCallback = func(c ssh.ConnMetadata) (*ssh.Permissions, error) {
+			perms := &ssh.Permissions{}
+			if next != nil {
+				p, err := next(c)
+				if err != nil {
+					return nil, err
+				}
+				if p != nil {
+					perms = p
+				}
+			}
+			if perms.Extensions == nil {
+				perms.Extensions = map[string]string{}
+			}
+			perms.Extensions[ExtAuthMethod] = "none"
+			return perms, nil
+		}
 	}
 }
 
-func (ts *TermServer) handleChannels(chans <-chan ssh.NewChannel, sshconn *ssh.ServerConn) {
-	// Service the incoming Channel channel in go routine
-	for newChannel := range chans {
-		go ts.handleChannel(newChannel, sshconn)
+func (ts *TermServer) serveConn(tcpConn net.Conn) {
+	if ts.HandshakeTimeout > 0 {
+		tcpConn.SetDeadline(time.Now().Add(ts.HandshakeTimeout))
+	}
+	vc := &versionConn{Conn: tcpConn}
+	sshConn, chans, reqs, err := ssh.NewServerConn(vc, ts.Config)
+	if err != nil {
+		tcpConn.Close()
+		ts.metrics().Counter(MetricHandshakeFailures, "reason", handshakeFailureReason(err)).Add(1)
+		ts.reportError(slog.LevelWarn, &OpError{
+			Op:            "handshake",
+			RemoteAddr:    tcpConn.RemoteAddr(),
+			ClientVersion: vc.version(),
+			Err:           err,
+		})
+		return
+	}
+	if ts.HandshakeTimeout > 0 {
+		tcpConn.SetDeadline(time.Time{})
+	}
+	conn := newConn(sshConn)
+	go ts.handleGlobalRequests(reqs, conn)
+	if ts.KeepAliveInterval > 0 {
+		go ts.keepAlive(conn)
+	}
+	ts.handleChannels(chans, conn)
+}
+
+// handleGlobalRequests answers the connection's global requests until it
+// closes, then stops its forwards.
+func (ts *TermServer) handleGlobalRequests(reqs <-chan *ssh.Request, conn *Conn) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			if ts.loginPending(conn) {
+				req.Reply(false, nil)
+				continue
+			}
+			ok, payload := ts.tcpipForward(req.Payload, conn)
+			req.Reply(ok, payload)
+		case "cancel-tcpip-forward":
+			var msg tcpipForwardMsg
+			ok := ssh.Unmarshal(req.Payload, &msg) == nil && conn.cancelForward(msg.Addr, int(msg.Port))
+			req.Reply(ok, nil)
+		case "hostkeys-prove-00@openssh.com":
+			ok, payload := false, []byte(nil)
+			if ts.HostKeys != nil {
+				ok, payload = ts.HostKeys.Prove(conn, req.Payload)
+			}
+			req.Reply(ok, payload)
+		case "no-more-sessions@openssh.com":
+			conn.setNoMoreSessions()
+			req.Reply(true, nil)
+		case "keepalive@openssh.com":
+			// Clients only want to see a reply.
+			req.Reply(false, nil)
+		default:
+			ts.reportError(slog.LevelDebug, ts.connError("request", conn, fmt.Errorf("unknown global request type %q", req.Type)))
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+	conn.closeForwards()
+}
+
+func (ts *TermServer) handleChannels(chans <-chan ssh.NewChannel, conn *Conn) {
+	active := ts.metrics().Gauge(MetricConnectionsActive)
+	active.Add(1)
+	defer active.Add(-1)
+
+	if ts.HostKeys != nil {
+		if err := ts.HostKeys.Advertise(conn); err != nil {
+			ts.reportError(slog.LevelWarn, ts.connError("hostkeys", conn, err))
+		}
+	}
+	if ts.OnConnect != nil {
+		ts.OnConnect(conn)
+	}
+	// x/crypto queues channel opens in chans before delivering later global
+	// requests, so when no-more-sessions@openssh.com is signalled the
+	// sessions opened before it have been counted or are still queued.
+	opened, limit := 0, -1
+loop:
+	for {
+		select {
+		case <-conn.noMore:
+			if limit < 0 {
+				limit = opened + len(chans)
+			}
+		case newChannel, ok := <-chans:
+			if !ok {
+				break loop
+			}
+			late := limit >= 0 && opened >= limit
+			opened++
+			conn.wg.Add(1)
+			go func() {
+				defer conn.wg.Done()
+				ts.handleChannel(newChannel, conn, late)
+			}()
+		}
+	}
+	conn.wg.Wait()
+	if ts.OnDisconnect != nil {
+		ts.OnDisconnect(conn)
 	}
 }
 
@@ -150,67 +324,258 @@ type subsystemReq struct {
 	Name string
 }
 
-func (ts *TermServer) handleChannel(newChannel ssh.NewChannel, sshconn *ssh.ServerConn) {
+type signalMsg struct {
+	Signal string
+}
+
+// handleChannel serves a channel opened on conn. late is set if it was opened
+// after a no-more-sessions@openssh.com request.
+func (ts *TermServer) handleChannel(newChannel ssh.NewChannel, conn *Conn, late bool) {
 	// Since we're handling a shell, we expect a
 	// channel type of "session". The also describes
 	// "x11", "direct-tcpip" and "forwarded-tcpip"
 	// channel types.
+	if newChannel.ChannelType() == "direct-tcpip" && ts.LocalForward != nil {
+		if ts.loginPending(conn) {
+			newChannel.Reject(ssh.Prohibited, "log in first")
+			ts.reportError(slog.LevelWarn, ts.connError("forward", conn, errors.New("forwarding before login")))
+			return
+		}
+		ts.handleDirectTCPIP(newChannel, conn)
+		return
+	}
 	if t := newChannel.ChannelType(); t != "session" {
 		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
+		ts.reportError(slog.LevelWarn, ts.connError("channel", conn, fmt.Errorf("rejected channel type %q", t)))
 		return
 	}
 
 	// At this point, we have the opportunity to reject the client's
 	// request for another logical connection
+	if late {
+		newChannel.Reject(ssh.Prohibited, "no more sessions")
+		ts.reportError(slog.LevelWarn, ts.connError("channel", conn, errors.New("session after no-more-sessions@openssh.com")))
+		return
+	}
+	if !conn.reserveSession(ts.MaxSessionsPerConn) {
+		newChannel.Reject(ssh.ResourceShortage, "too many sessions")
+		ts.reportError(slog.LevelWarn, ts.connError("limit", conn, errors.New("too many sessions")))
+		return
+	}
 	connection, requests, err := newChannel.Accept()
 	if err != nil {
+		conn.releaseSession()
 		return
 	}
 
+	session := newSession(ts, conn, connection)
+	conn.addSession(session)
+	conn.wg.Add(1)
+	m := ts.metrics()
+	m.Gauge(MetricSessionsActive).Add(1)
+
+	// t is set by pty-req, and term once a shell has started the handler.
+	var t *tb.Termbox
 	var term Term
+	// started is set once a subsystem or the handler has been started.
+	var started bool
 
 	// Sessions have out-of-band requests such as "shell", "pty-req" and "env"
 	go func() {
+		defer func() {
+			conn.removeSession(session)
+			conn.releaseSession()
+			ts.endSession(session)
+			conn.wg.Done()
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				ts.sessionPanic(session, t, r)
+				go ssh.DiscardRequests(requests)
+			}
+		}()
 		for req := range requests {
 			switch req.Type {
 			case "subsystem":
-				if req.WantReply {
+				var sub subsystemReq
+				if err := ssh.Unmarshal(req.Payload, &sub); err != nil {
+					ts.reportError(slog.LevelWarn, ts.connError("request", conn, fmt.Errorf("malformed subsystem request: %w", err)))
 					req.Reply(false, nil)
+					continue
 				}
+				h, ok := ts.Subsystems[sub.Name]
+				if !ok || started || t != nil || ts.loginPending(conn) {
+					ts.reportError(slog.LevelDebug, ts.connError("subsystem", conn, fmt.Errorf("rejected subsystem %q", sub.Name)))
+					req.Reply(false, nil)
+					continue
+				}
+				started = true
+				req.Reply(true, nil)
+				session.goSafe(nil, func() {
+					session.Exit(ts.runSubsystem(h, sub.Name, connection, session))
+				})
 			case "shell":
-				// We only accept the default shell
-				// (i.e. no command in the Payload)
-				if len(req.Payload) == 0 {
-					req.Reply(true, nil)
+				// The handler needs the terminal set up by pty-req.
+				if started || t == nil {
+					req.Reply(false, nil)
+					continue
 				}
+				started = true
+				term = ts.handler()(t, session)
+				req.Reply(true, nil)
 			case "env":
+				var env envVar
+				// the environment is fixed once something runs
+				ok := !started && ssh.Unmarshal(req.Payload, &env) == nil && ts.acceptEnv(session, env)
+				if ok {
+					session.env = append(session.env, env.Name+"="+env.Value)
+				}
+				if req.WantReply {
+					req.Reply(ok, nil)
+				}
 			case "pty-req":
+				if started || t != nil || conn.restricted(ExtNoPTY) {
+					req.Reply(false, nil)
+					continue
+				}
 				var pty ptyReq
-				ssh.Unmarshal(req.Payload, &pty)
-
-				// Responding true (OK) here will let the client
-				// know we have a pty ready for input
-
-				t, _ := tb.Init(connection, connection, pty.Term, int(pty.Width), int(pty.Height))
-
-				term = ts.Handler(t, sshconn)
+				if err := ssh.Unmarshal(req.Payload, &pty); err != nil {
+					ts.reportError(slog.LevelWarn, ts.connError("request", conn, fmt.Errorf("malformed pty-req: %w", err)))
+					req.Reply(false, nil)
+					continue
+				}
 
+				// The terminal is set up right away so that an unknown
+				// TERM fails the pty-req, but the handler waits for the
+				// shell request, letting env requests come in between.
+				var err error
+				t, err = ts.initTerm(session, connection, connection, pty.Term, int(pty.Width), int(pty.Height))
+				if err != nil {
+					req.Reply(false, nil)
+					continue
+				}
 				req.Reply(true, nil)
+			case "auth-agent-req@openssh.com":
+				ok := !conn.restricted(ExtNoAgentForwarding)
+				if ok {
+					session.requestAgent()
+				}
+				if req.WantReply {
+					req.Reply(ok, nil)
+				}
+			case "signal":
+				var sig signalMsg
+				if t != nil && ssh.Unmarshal(req.Payload, &sig) == nil {
+					t.Signal(sig.Signal)
+				}
+			case "break":
+				// RFC 4335: the reply says whether a BREAK was delivered.
+				if t != nil {
+					t.Signal("BREAK")
+				}
+				if req.WantReply {
+					req.Reply(t != nil, nil)
+				}
+			case "eow@openssh.com":
+				// The client will send no more data, which the Termbox
+				// learns from EOF anyway.
+			case "simple@putty.projects.tartarus.org":
+				// PuTTY announcing it will open no other channel.
+			case "winadj@putty.projects.tartarus.org":
+				// PuTTY measures the round trip, any reply will do.
+				req.Reply(false, nil)
 			case "window-change":
-				w, h := parseDims(req.Payload)
-				if term != nil {
+				w, h, ok := parseDims(req.Payload)
+				m.Counter(MetricResizes).Add(1)
+				if ok && term != nil {
 					term.Resize(int(w), int(h))
+				} else if ok && t != nil {
+					t.Resize(int(w), int(h))
+				}
+			default:
+				ts.reportError(slog.LevelDebug, ts.connError("request", conn, fmt.Errorf("unknown request type %q", req.Type)))
+				if req.WantReply {
+					req.Reply(false, nil)
 				}
 			}
 		}
 	}()
 }
 
+// loginPending reports whether conn is confined to the Handler by
+// RequireLogin.
+func (ts *TermServer) loginPending(conn *Conn) bool {
+	return ts.RequireLogin && conn.loginIdentity() == ""
+}
+
+// runSubsystem runs h on s and returns the session's exit status.
+func (ts *TermServer) runSubsystem(h SubsystemHandler, name string, ch ssh.Channel, s *Session) int {
+	err := h(ch, s)
+	if err == nil {
+		return 0
+	}
+	var status ExitStatus
+	if errors.As(err, &status) {
+		return int(status)
+	}
+	ts.reportError(slog.LevelWarn, ts.sessionError("subsystem", s, fmt.Errorf("%s: %w", name, err)))
+	return 1
+}
+
+// initTerm initializes the session's Termbox on in and out, ready for the
+// handler. Failures are reported.
+func (ts *TermServer) initTerm(s *Session, in io.Reader, out io.Writer, term string, w, h int) (*tb.Termbox, error) {
+	t, err := tb.Init(countingReader{in, &s.bytesIn}, countingWriter{out, &s.bytesOut}, term, w, h)
+	if err != nil {
+		ts.reportError(slog.LevelWarn, ts.sessionError("init", s, fmt.Errorf("TERM %q: %w", term, err)), slog.String("term", term))
+		return nil, err
+	}
+	t.SetFlushHook(ts.observeFlush())
+	if ts.IdleTimeout > 0 {
+		go ts.watchIdle(s, t)
+	}
+	ts.metrics().Counter(MetricSessions, "term", termLabel(term)).Add(1)
+	s.term = term
+	return t, nil
+}
+
+// endSession releases what a session held once it has ended.
+func (ts *TermServer) endSession(s *Session) {
+	s.cancel()
+	s.closeAgent()
+	m := ts.metrics()
+	m.Gauge(MetricSessionsActive).Add(-1)
+	m.Summary(MetricSessionBytesIn).Observe(float64(atomic.LoadInt64(&s.bytesIn)))
+	m.Summary(MetricSessionBytesOut).Observe(float64(atomic.LoadInt64(&s.bytesOut)))
+}
+
 // =======================
 
+// sessionPanic restores the client's terminal after a recovered panic, ends
+// the session with an error status and reports the panic.
+func (ts *TermServer) sessionPanic(s *Session, t *tb.Termbox, v interface{}) {
+	stack := debug.Stack()
+	if t != nil {
+		t.Close()
+	}
+	s.Exit(1)
+	if ts.OnPanic != nil {
+		ts.OnPanic(s, v, stack)
+		return
+	}
+	ts.logger().Error("sshterm: session panic",
+		slog.String("user", s.User()),
+		slog.String("remote_addr", s.RemoteAddr().String()),
+		slog.Any("panic", v),
+		slog.String("stack", string(stack)))
+}
+
 // parseDims extracts terminal dimensions (width x height) from the provided buffer.
-func parseDims(b []byte) (uint32, uint32) {
+func parseDims(b []byte) (uint32, uint32, bool) {
+	if len(b) < 8 {
+		return 0, 0, false
+	}
 	w := binary.BigEndian.Uint32(b)
 	h := binary.BigEndian.Uint32(b[4:])
-	return w, h
+	return w, h, true
 }
@@ -0,0 +1,112 @@
+package sshterm
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// listenTest serves ts on a local port until the test ends.
+func listenTest(t *testing.T, ts *TermServer) string {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Config.AddHostKey(hostSigner)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go ts.Listen(l)
+	return l.Addr().String()
+}
+
+func TestNoMoreSessions(t *testing.T) {
+	ts := New(&ssh.ServerConfig{NoClientAuth: true})
+	// Hold up handleChannels so the request is answered before the session
+	// it follows is handled, as when OnConnect is slow.
+	ts.OnConnect = func(c *Conn) { time.Sleep(100 * time.Millisecond) }
+	client, err := ssh.Dial("tcp", listenTest(t, ts), &ssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// OpenSSH sends the request right after opening its session.
+	opened := make(chan error, 1)
+	go func() {
+		ch, reqs, err := client.OpenChannel("session", nil)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+			defer ch.Close()
+		}
+		opened <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if _, _, err := client.SendRequest("no-more-sessions@openssh.com", true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-opened; err != nil {
+		t.Fatalf("session opened before no-more-sessions refused: %v", err)
+	}
+
+	if _, _, err := client.OpenChannel("session", nil); err == nil {
+		t.Error("session opened after no-more-sessions accepted")
+	}
+}
+
+func TestEnvAfterPTY(t *testing.T) {
+	envs := make(chan []string, 1)
+	ts := New(&ssh.ServerConfig{NoClientAuth: true})
+	ts.Handler = func(t *tb.Termbox, s *Session) Term {
+		envs <- s.Env()
+		return nil
+	}
+	client, err := ssh.Dial("tcp", listenTest(t, ts), &ssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// OpenSSH sends SendEnv variables after the pty-req.
+	if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Setenv("LANG", "en_US.UTF-8"); err != nil {
+		t.Fatalf("env after pty-req refused: %v", err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case env := <-envs:
+		if !slices.Contains(env, "LANG=en_US.UTF-8") {
+			t.Errorf("handler got environment %q", env)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not started by the shell request")
+	}
+	if err := sess.Setenv("TZ", "UTC"); err == nil {
+		t.Error("env accepted after the shell started")
+	}
+}
@@ -0,0 +1,346 @@
+package sshterm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// TelnetServer serves a TermServer's Handler over telnet, with the same
+// middleware, limits and metrics as its SSH sessions. The window size comes
+// from NAWS and TERM from the TERMINAL-TYPE option. Clients that do not
+// negotiate, such as raw TCP connections, get an 80x24 terminal of type
+// Term.
+//
+// Telnet is neither authenticated nor encrypted. Sessions have the user name
+// User, and middleware such as LoginScreen can establish who is connected.
+type TelnetServer struct {
+	Server *TermServer
+	// User is the user name of telnet sessions, "telnet" by default.
+	User string
+	// Term is the TERM used when the client does not report one, "xterm" by
+	// default.
+	Term string
+	// NegotiationTimeout bounds the wait for the client's window size and
+	// terminal type, one second by default.
+	NegotiationTimeout time.Duration
+}
+
+// Telnet commands and options.
+const (
+	telnetSE   = 240
+	telnetBRK  = 243
+	telnetIP   = 244
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptEcho  = 1
+	telnetOptSGA   = 3
+	telnetOptTType = 24
+	telnetOptNAWS  = 31
+
+	telnetTTypeIs   = 0
+	telnetTTypeSend = 1
+)
+
+// Listen accepts telnet connections on l until it is closed.
+func (s *TelnetServer) Listen(l net.Listener) {
+	ts := s.Server
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			ts.reportError(slog.LevelError, &OpError{Op: "accept", Err: err})
+			continue
+		}
+		release, ok := ts.admit(conn)
+		if !ok {
+			continue
+		}
+		go func() {
+			defer release()
+			s.serve(conn)
+		}()
+	}
+}
+
+// telnetConn is a session's telnet connection. Writes escape IAC.
+type telnetConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *telnetConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if bytes.IndexByte(b, telnetIAC) < 0 {
+		return c.Conn.Write(b)
+	}
+	_, err := c.Conn.Write(bytes.ReplaceAll(b, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// command sends a telnet command, unescaped.
+func (c *telnetConn) command(b ...byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+func (s *TelnetServer) serve(conn net.Conn) {
+	ts := s.Server
+	tc := &telnetConn{Conn: conn}
+	defer tc.Close()
+
+	tc.command(
+		telnetIAC, telnetWILL, telnetOptEcho,
+		telnetIAC, telnetWILL, telnetOptSGA,
+		telnetIAC, telnetDO, telnetOptSGA,
+		telnetIAC, telnetDO, telnetOptNAWS,
+		telnetIAC, telnetDO, telnetOptTType,
+	)
+
+	// Negotiation happens on the reading goroutine, the results are
+	// guarded by mu.
+	var (
+		mu       sync.Mutex
+		w, h     = 80, 24
+		ttype    string
+		t        *tb.Termbox
+		term     Term
+		typeDone = make(chan struct{})
+		typeOnce sync.Once
+	)
+	typeKnown := func() { typeOnce.Do(func() { close(typeDone) }) }
+	p := &telnetParser{
+		onCommand: func(cmd, opt byte) {
+			switch cmd {
+			case telnetDO:
+				if opt != telnetOptEcho && opt != telnetOptSGA {
+					tc.command(telnetIAC, telnetWONT, opt)
+				}
+			case telnetWILL:
+				switch opt {
+				case telnetOptTType:
+					tc.command(telnetIAC, telnetSB, telnetOptTType, telnetTTypeSend, telnetIAC, telnetSE)
+				case telnetOptSGA, telnetOptNAWS:
+				default:
+					tc.command(telnetIAC, telnetDONT, opt)
+				}
+			case telnetWONT:
+				if opt == telnetOptTType {
+					typeKnown()
+				}
+			case telnetIP, telnetBRK:
+				mu.Lock()
+				if t != nil {
+					if cmd == telnetIP {
+						t.Signal("INT")
+					} else {
+						t.Signal("BREAK")
+					}
+				}
+				mu.Unlock()
+			}
+		},
+		onSub: func(opt byte, data []byte) {
+			switch {
+			case opt == telnetOptNAWS && len(data) == 4:
+				nw, nh := int(binary.BigEndian.Uint16(data)), int(binary.BigEndian.Uint16(data[2:]))
+				mu.Lock()
+				w, h = nw, nh
+				current := term
+				mu.Unlock()
+				ts.metrics().Counter(MetricResizes).Add(1)
+				if current != nil {
+					current.Resize(nw, nh)
+				}
+			case opt == telnetOptTType && len(data) > 1 && data[0] == telnetTTypeIs:
+				mu.Lock()
+				if ttype == "" {
+					ttype = string(bytes.ToLower(data[1:]))
+				}
+				mu.Unlock()
+				typeKnown()
+			}
+		},
+	}
+
+	in, inw := io.Pipe()
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if data := p.parse(buf[:n]); len(data) > 0 {
+				if _, err := inw.Write(data); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				inw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	timeout := s.NegotiationTimeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	select {
+	case <-typeDone:
+	case <-time.After(timeout):
+	}
+	mu.Lock()
+	termName, width, height := ttype, w, h
+	mu.Unlock()
+	if termName == "" {
+		termName = s.Term
+		if termName == "" {
+			termName = "xterm"
+		}
+	}
+	user := s.User
+	if user == "" {
+		user = "telnet"
+	}
+
+	session := newTransportSession(ts, user, conn.RemoteAddr(), tc)
+	ts.metrics().Gauge(MetricSessionsActive).Add(1)
+	defer ts.endSession(session)
+
+	var tbox *tb.Termbox
+	defer func() {
+		if r := recover(); r != nil {
+			ts.sessionPanic(session, tbox, r)
+		}
+	}()
+	tbox, err := ts.initTerm(session, in, tc, termName, width, height)
+	if err != nil {
+		return
+	}
+	mu.Lock()
+	t = tbox
+	mu.Unlock()
+	handler := ts.handler()(tbox, session)
+
+	// the window may have changed while the handler started
+	mu.Lock()
+	term = handler
+	resized := w != width || h != height
+	width, height = w, h
+	mu.Unlock()
+	if resized && handler != nil {
+		handler.Resize(width, height)
+	}
+	<-closed
+}
+
+// telnetParser separates telnet commands from the data in a telnet stream.
+// Input may be split anywhere between calls to parse.
+type telnetParser struct {
+	onCommand func(cmd, opt byte)
+	onSub     func(opt byte, data []byte)
+
+	state int
+	cmd   byte
+	sb    []byte
+	cr    bool
+}
+
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOpt
+	telnetStateSB
+	telnetStateSBIAC
+)
+
+// maxTelnetSub bounds the size of a subnegotiation.
+const maxTelnetSub = 256
+
+// parse handles the commands in b and returns the data, reusing b. A CR
+// followed by NUL or LF is reduced to the CR, as sent by the Enter key.
+func (p *telnetParser) parse(b []byte) []byte {
+	out := b[:0]
+	for _, c := range b {
+		switch p.state {
+		case telnetStateData:
+			if c == telnetIAC {
+				p.state = telnetStateIAC
+				continue
+			}
+			if p.cr && (c == 0 || c == '\n') {
+				p.cr = false
+				continue
+			}
+			p.cr = c == '\r'
+			out = append(out, c)
+		case telnetStateIAC:
+			switch c {
+			case telnetIAC:
+				p.state = telnetStateData
+				p.cr = false
+				out = append(out, c)
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				p.cmd = c
+				p.state = telnetStateOpt
+			case telnetSB:
+				p.sb = p.sb[:0]
+				p.state = telnetStateSB
+			default:
+				p.state = telnetStateData
+				if p.onCommand != nil {
+					p.onCommand(c, 0)
+				}
+			}
+		case telnetStateOpt:
+			p.state = telnetStateData
+			if p.onCommand != nil {
+				p.onCommand(p.cmd, c)
+			}
+		case telnetStateSB:
+			if c == telnetIAC {
+				p.state = telnetStateSBIAC
+			} else if len(p.sb) < maxTelnetSub {
+				p.sb = append(p.sb, c)
+			}
+		case telnetStateSBIAC:
+			switch c {
+			case telnetSE:
+				p.state = telnetStateData
+				if len(p.sb) > 0 && p.onSub != nil {
+					p.onSub(p.sb[0], p.sb[1:])
+				}
+			case telnetIAC:
+				p.state = telnetStateSB
+				if len(p.sb) < maxTelnetSub {
+					p.sb = append(p.sb, c)
+				}
+			default:
+				// a malformed subnegotiation, drop it
+				p.state = telnetStateData
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,56 @@
+package sshterm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTelnetParser(t *testing.T) {
+	type sub struct {
+		opt  byte
+		data string
+	}
+	var cmds [][2]byte
+	var subs []sub
+	p := &telnetParser{
+		onCommand: func(cmd, opt byte) { cmds = append(cmds, [2]byte{cmd, opt}) },
+		onSub:     func(opt byte, data []byte) { subs = append(subs, sub{opt, string(data)}) },
+	}
+
+	stream := []byte("ab\xff\xfb\x18c\r\x00d\r\ne\xff\xff" +
+		"\xff\xfa\x1f\x00\x50\x00\x18\xff\xf0" +
+		"\xff\xfa\x18\x00XTERM\xff\xf0" +
+		"\xff\xfa\x1f\x00\xff\xff\x00\x30\xff\xf0" +
+		"\xff\xf4f")
+	var data []byte
+	// split the stream everywhere to exercise the parser's state
+	for i := 0; i < len(stream); i += 3 {
+		end := i + 3
+		if end > len(stream) {
+			end = len(stream)
+		}
+		chunk := append([]byte(nil), stream[i:end]...)
+		data = append(data, p.parse(chunk)...)
+	}
+
+	if want := []byte("abc\rd\re\xfff"); !bytes.Equal(data, want) {
+		t.Errorf("data = %q, want %q", data, want)
+	}
+	wantCmds := [][2]byte{{telnetWILL, telnetOptTType}, {telnetIP, 0}}
+	if len(cmds) != len(wantCmds) || cmds[0] != wantCmds[0] || cmds[1] != wantCmds[1] {
+		t.Errorf("commands = %v, want %v", cmds, wantCmds)
+	}
+	wantSubs := []sub{
+		{telnetOptNAWS, "\x00\x50\x00\x18"},
+		{telnetOptTType, "\x00XTERM"},
+		{telnetOptNAWS, "\x00\xff\x00\x30"},
+	}
+	if len(subs) != len(wantSubs) {
+		t.Fatalf("subnegotiations = %q, want %q", subs, wantSubs)
+	}
+	for i := range subs {
+		if subs[i] != wantSubs[i] {
+			t.Errorf("subnegotiation %d = %q, want %q", i, subs[i], wantSubs[i])
+		}
+	}
+}
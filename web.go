@@ -0,0 +1,220 @@
+package sshterm
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"path"
+
+	"golang.org/x/net/websocket"
+
+	tb "github.com/andyleap/SSHTerm/SSHTermbox"
+)
+
+// WebGateway serves a TermServer's Handler to browsers, with the same
+// middleware and metrics as its SSH sessions. The page at its root runs
+// xterm.js, which connects back to the WebSocket at "ws" next to it, so a
+// gateway mounted at "/term/" serves its WebSocket at "/term/ws".
+type WebGateway struct {
+	Server *TermServer
+	// User returns the user name for a request, e.g. from a session cookie.
+	// If it returns an error, the request is refused. If nil, every visitor
+	// is "web".
+	User func(r *http.Request) (string, error)
+	// Term is the TERM the Termbox is initialized for, "xterm-256color" by
+	// default.
+	Term  string
+	Title string
+	// XtermURL and FitURL are where the @xterm/xterm and @xterm/addon-fit
+	// packages are loaded from. They default to jsDelivr.
+	XtermURL string
+	FitURL   string
+}
+
+var webPage = template.Must(template.New("web").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.XtermURL}}/css/xterm.css">
+<style>html, body, #term { height: 100%; margin: 0; background: #000; }</style>
+</head>
+<body>
+<div id="term"></div>
+<script src="{{.XtermURL}}/lib/xterm.js"></script>
+<script src="{{.FitURL}}/lib/addon-fit.js"></script>
+<script>
+(function() {
+	var term = new Terminal(), fit = new FitAddon.FitAddon();
+	term.loadAddon(fit);
+	term.open(document.getElementById("term"));
+	fit.fit();
+	var proto = location.protocol === "https:" ? "wss://" : "ws://";
+	var ws = new WebSocket(proto + location.host + location.pathname.replace(/[^\/]*$/, "") + "ws");
+	ws.binaryType = "arraybuffer";
+	var enc = new TextEncoder();
+	function send(data) {
+		if (ws.readyState === WebSocket.OPEN) ws.send(data);
+	}
+	function resize() {
+		send(JSON.stringify({type: "resize", cols: term.cols, rows: term.rows}));
+	}
+	ws.onopen = function() { resize(); term.focus(); };
+	ws.onmessage = function(e) { term.write(new Uint8Array(e.data)); };
+	ws.onclose = function() { term.write("\r\n[disconnected]\r\n"); };
+	term.onData(function(d) { send(enc.encode(d)); });
+	term.onBinary(function(d) {
+		var b = new Uint8Array(d.length);
+		for (var i = 0; i < d.length; i++) b[i] = d.charCodeAt(i) & 255;
+		send(b);
+	});
+	term.onResize(resize);
+	window.addEventListener("resize", function() { fit.fit(); });
+})();
+</script>
+</body>
+</html>
+`))
+
+func (g *WebGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := "web"
+	if g.User != nil {
+		u, err := g.User(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		user = u
+	}
+	if path.Base(r.URL.Path) == "ws" {
+		websocket.Server{
+			Handshake: sameOrigin,
+			Handler: func(ws *websocket.Conn) {
+				g.serve(ws, user, webAddr(r.RemoteAddr))
+			},
+		}.ServeHTTP(w, r)
+		return
+	}
+	data := *g
+	if data.Title == "" {
+		data.Title = "Terminal"
+	}
+	if data.XtermURL == "" {
+		data.XtermURL = "https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0"
+	}
+	if data.FitURL == "" {
+		data.FitURL = "https://cdn.jsdelivr.net/npm/@xterm/addon-fit@0.10.0"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	webPage.Execute(w, data)
+}
+
+// sameOrigin refuses WebSockets opened by pages of other sites, which would
+// otherwise be able to use the visitor's cookies.
+func sameOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil || origin.Host != r.Host {
+		return errors.New("sshterm: cross-origin WebSocket refused")
+	}
+	config.Origin = origin
+	return nil
+}
+
+// webAddr is the remote address of a browser.
+type webAddr string
+
+func (a webAddr) Network() string { return "websocket" }
+func (a webAddr) String() string  { return string(a) }
+
+// webFrame is a frame received from the page: terminal input in binary
+// frames, webMsg control messages in text frames.
+type webFrame struct {
+	binary bool
+	data   []byte
+}
+
+var webCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*webFrame)
+		f.binary = payloadType == websocket.BinaryFrame
+		f.data = data
+		return nil
+	},
+}
+
+type webMsg struct {
+	Type string `json:"type"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// webChannel is a session's WebSocket. Closing it also ends the input the
+// Termbox reads.
+type webChannel struct {
+	*websocket.Conn
+	in *io.PipeWriter
+}
+
+func (c webChannel) Close() error {
+	c.in.Close()
+	return c.Conn.Close()
+}
+
+func (g *WebGateway) serve(ws *websocket.Conn, user string, remote net.Addr) {
+	ts := g.Server
+	ws.PayloadType = websocket.BinaryFrame
+
+	// The page sends its size as soon as it connects.
+	w, h := 80, 24
+	var f webFrame
+	if err := webCodec.Receive(ws, &f); err != nil {
+		ws.Close()
+		return
+	}
+	var msg webMsg
+	if !f.binary && json.Unmarshal(f.data, &msg) == nil && msg.Type == "resize" && msg.Cols > 0 && msg.Rows > 0 {
+		w, h = msg.Cols, msg.Rows
+		f = webFrame{}
+	}
+
+	in, inw := io.Pipe()
+	s := newTransportSession(ts, user, remote, webChannel{ws, inw})
+	s.verified = g.User != nil
+	ts.metrics().Gauge(MetricSessionsActive).Add(1)
+	defer ts.endSession(s)
+	defer s.ch.Close()
+
+	var t *tb.Termbox
+	defer func() {
+		if r := recover(); r != nil {
+			ts.sessionPanic(s, t, r)
+		}
+	}()
+	termName := g.Term
+	if termName == "" {
+		termName = "xterm-256color"
+	}
+	t, err := ts.initTerm(s, in, ws, termName, w, h)
+	if err != nil {
+		return
+	}
+	term := ts.handler()(t, s)
+	for {
+		if f.binary {
+			if _, err := inw.Write(f.data); err != nil {
+				return
+			}
+		} else if json.Unmarshal(f.data, &msg) == nil && msg.Type == "resize" && term != nil {
+			term.Resize(msg.Cols, msg.Rows)
+		}
+		if err := webCodec.Receive(ws, &f); err != nil {
+			return
+		}
+	}
+}